@@ -2,10 +2,10 @@ package main
 
 import (
 	"errors"
-	"fmt"
-	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
@@ -14,30 +14,55 @@ import (
 
 func main() {
 
-	fmt.Println(GetAllUsers(""))
+	users, err := GetAllUsers("")
+	logger().Info("GetAllUsers", "users", users, "error", err)
+	FlushMetrics()
+	FlushTraces()
 }
 
 //Table Structure
 type UserInfo struct {
 
 	// User Id  user
-	UserId string `json:"userId,omitempty"`
+	UserId string `json:"userId,omitempty" validate:"required,max=128,format=id"`
 
 	// First name of the logged user
-	FirstName string `json:"firstName,omitempty"`
+	FirstName string `json:"firstName,omitempty" validate:"max=64,chars=name"`
 
 	// Last name of the logged user
-	LastName string `json:"lastName,omitempty"`
+	LastName string `json:"lastName,omitempty" validate:"max=64,chars=name"`
+
+	// Set by CreateNewUser
+	CreatedAt string `json:"createdAt,omitempty"`
+
+	// Set by CreateNewUser and UpdateUserInfo
+	UpdatedAt string `json:"updatedAt,omitempty"`
+
+	// Actor that created the user, see SetActor
+	CreatedBy string `json:"createdBy,omitempty"`
+
+	// Set by SoftDeleteUser, reads skip the user while set
+	DeletedAt string `json:"deletedAt,omitempty"`
 }
 
 //GetStoreTemplate details
 func GetUser(tableName, userID string) (UserInfo, error) {
 
+	start := time.Now()
+	opLogger := logger().With("operation", "GetUser", "table", tableName, "userId", userID)
+
 	var userInfo UserInfo
+	if errValidate := ValidateField("userId", userID, userIDRules); errValidate != nil {
+		opLogger.Warn("ValidationError", "error", errValidate.Error(), "durationMs", sinceMs(start))
+		return userInfo, errValidate
+	}
 	region := "us-east-2"
 	awsSession, _ := session.NewSession(&aws.Config{
 		Region: aws.String(region)},
 	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
 
 	dynaClient := dynamodb.New(awsSession)
 
@@ -46,27 +71,40 @@ func GetUser(tableName, userID string) (UserInfo, error) {
 	//Primary key
 	keys["userId"] = &itemKeyValue
 
-	getItemInput := dynamodb.GetItemInput{TableName: aws.String(tableName), Key: keys}
+	getItemInput := dynamodb.GetItemInput{TableName: aws.String(tableName), Key: keys, ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal)}
 	response, errFromLookup := dynaClient.GetItem(&getItemInput)
+	recordCall("GetUser", tableName, start, errFromLookup)
 	if errFromLookup != nil {
+		if _, open := errFromLookup.(*CircuitOpenError); open {
+			opLogger.Warn("CircuitOpen", "error", errFromLookup.Error(), "durationMs", sinceMs(start))
+			return userInfo, errFromLookup
+		}
 		errorString := "FailedTableLookupError" + "[" + errFromLookup.Error() + "]"
-		fmt.Println(errorString)
+		opLogger.Error("FailedTableLookupError", "error", errFromLookup.Error(), "durationMs", sinceMs(start))
 		return userInfo, errors.New(errorString)
 	}
+	recordCapacity("GetUser", tableName, response.ConsumedCapacity)
 	if response.Item == nil {
+		recordItemCount("GetUser", tableName, 0)
 		errorString := "UserNotFound" + ": " + userID
-		fmt.Println(errorString)
+		opLogger.Warn("UserNotFound", "durationMs", sinceMs(start))
 		return userInfo, errors.New(errorString)
 	}
 
 	errFromItemUnmarshal := dynamodbattribute.UnmarshalMap(response.Item, &userInfo)
 	if errFromItemUnmarshal != nil {
 		errorString := "ItemUnMarshalError" + ": " + userID
-		fmt.Println(errorString)
+		opLogger.Error("ItemUnMarshalError", "error", errFromItemUnmarshal.Error(), "durationMs", sinceMs(start))
 		return userInfo, errors.New(errorString)
 	}
+	if userInfo.DeletedAt != "" || itemExpired(response.Item) {
+		errorString := "UserNotFound" + ": " + userID
+		opLogger.Warn("UserNotFound", "deletedAt", userInfo.DeletedAt, "durationMs", sinceMs(start))
+		return UserInfo{}, errors.New(errorString)
+	}
 
-	fmt.Println(" User details of userID : " + userID + " Fetched Successfully")
+	recordItemCount("GetUser", tableName, 1)
+	opLogger.Info("User details Fetched Successfully", "durationMs", sinceMs(start))
 
 	return userInfo, nil
 }
@@ -74,51 +112,96 @@ func GetUser(tableName, userID string) (UserInfo, error) {
 //GetAllUsers Details
 func GetAllUsers(tableName string) ([]UserInfo, error) {
 
+	start := time.Now()
+	opLogger := logger().With("operation", "GetAllUsers", "table", tableName)
+
 	users := []UserInfo{}
 	region := "us-east-2"
 	awsSession, _ := session.NewSession(&aws.Config{
 		Region: aws.String(region)},
 	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
 
 	dynaClient := dynamodb.New(awsSession)
 
+	//Soft deleted and expired users are skipped
+	expr, errExpression := expression.NewBuilder().
+		WithFilter(readable()).
+		Build()
+	if errExpression != nil {
+		opLogger.Error("Query Expression Error", "error", errExpression.Error(), "durationMs", sinceMs(start))
+		return users, errExpression
+	}
+
 	var queryInput = &dynamodb.ScanInput{
-		TableName: aws.String(tableName),
+		TableName:                 aws.String(tableName),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnConsumedCapacity:    aws.String(dynamodb.ReturnConsumedCapacityTotal),
 	}
 
-	var resp, errQueryDynamoDB = dynaClient.Scan(queryInput)
+	// The filter is applied per page, so pages up to the last can hold no readable user
+	var errUnMarshal error
+	errQueryDynamoDB := dynaClient.ScanPages(queryInput, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		recordCapacity("GetAllUsers", tableName, page.ConsumedCapacity)
+		var pageUsers []UserInfo
+		if errUnMarshal = dynamodbattribute.UnmarshalListOfMaps(page.Items, &pageUsers); errUnMarshal != nil {
+			return false
+		}
+		users = append(users, pageUsers...)
+		return true
+	})
+	recordCall("GetAllUsers", tableName, start, errQueryDynamoDB)
 	if errQueryDynamoDB != nil {
-		errorString := "Failed to Lookup table" + errQueryDynamoDB.Error()
-		fmt.Println(errorString)
+		opLogger.Error("Failed to Lookup table", "error", errQueryDynamoDB.Error(), "durationMs", sinceMs(start))
 		return users, errQueryDynamoDB
 	}
+	if errUnMarshal != nil {
+		opLogger.Error("UnMarshal Stores Error", "error", errUnMarshal.Error(), "durationMs", sinceMs(start))
+		return users, errUnMarshal
+	}
+	recordItemCount("GetAllUsers", tableName, len(users))
 
-	if len(resp.Items) > 0 {
-		errUnMarshal := dynamodbattribute.UnmarshalListOfMaps(resp.Items, &users)
-		if errUnMarshal != nil {
-			errorString := "UnMarshal Stores Error" + errUnMarshal.Error()
-			fmt.Println(errorString)
-			return users, errUnMarshal
-		}
-	} else {
+	if len(users) == 0 {
 		errorString := "Users Not found"
-		fmt.Println(errorString)
+		opLogger.Warn("Users Not found", "durationMs", sinceMs(start))
 		return users, errors.New(errorString)
 	}
 
-	fmt.Println("Successfully Fetched " + strconv.FormatInt(*resp.Count, 10))
+	opLogger.Info("Successfully Fetched", "count", len(users), "durationMs", sinceMs(start))
 
 	return users, nil
 }
 
 //CreateNewUser
 func CreateNewUser(userTableName string, userInfo UserInfo) (UserInfo, error) {
+	start := time.Now()
+	opLogger := logger().With("operation", "CreateNewUser", "table", userTableName, "userId", userInfo.UserId)
+
 	var user UserInfo
+	if userInfo.UserId == "" {
+		userInfo.UserId = NewUserID()
+		opLogger = opLogger.With("userId", userInfo.UserId)
+	}
+	userInfo.CreatedAt = auditTimestamp()
+	userInfo.UpdatedAt = userInfo.CreatedAt
+	userInfo.CreatedBy = currentActor()
+
+	if errValidate := Validate(userInfo); errValidate != nil {
+		opLogger.Warn("ValidationError", "error", errValidate.Error(), "durationMs", sinceMs(start))
+		return user, errValidate
+	}
 
 	region := "us-east-2"
 	awsSession, _ := session.NewSession(&aws.Config{
 		Region: aws.String(region)},
 	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
 
 	dynaClient := dynamodb.New(awsSession)
 
@@ -126,32 +209,80 @@ func CreateNewUser(userTableName string, userInfo UserInfo) (UserInfo, error) {
 	inputItemValue, errMarshalMap := dynamodbattribute.MarshalMap(userInfo)
 	if errMarshalMap != nil {
 		errorString := "Marshal Map Error" + "[" + errMarshalMap.Error() + "]"
-		fmt.Println(errorString)
+		opLogger.Error("Marshal Map Error", "error", errMarshalMap.Error(), "durationMs", sinceMs(start))
 		return user, errors.New(errorString)
 	}
 
+	// A readable user is never replaced, its createdAt and createdBy are kept by UpdateUserInfo.
+	// The ID of a soft deleted or expired user can be taken by a new one
+	expr, errExpression := expression.NewBuilder().
+		WithCondition(creatable()).
+		Build()
+	if errExpression != nil {
+		opLogger.Error("Query Expression Error", "error", errExpression.Error(), "durationMs", sinceMs(start))
+		return user, errExpression
+	}
 	input := &dynamodb.PutItemInput{
-		Item:      inputItemValue,
-		TableName: aws.String(userTableName),
+		Item:                      inputItemValue,
+		TableName:                 aws.String(userTableName),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnConsumedCapacity:    aws.String(dynamodb.ReturnConsumedCapacityTotal),
 	}
 
-	_, errPutItem := dynaClient.PutItem(input)
+	// With an audit table the put and its audit entry are written in one transaction
+	putOutput := &dynamodb.PutItemOutput{}
+	var errPutItem error
+	if currentAuditTable() != "" {
+		write := &dynamodb.TransactWriteItem{Put: &dynamodb.Put{Item: inputItemValue, TableName: aws.String(userTableName),
+			ConditionExpression: input.ConditionExpression, ExpressionAttributeNames: input.ExpressionAttributeNames, ExpressionAttributeValues: input.ExpressionAttributeValues}}
+		_, putOutput.ConsumedCapacity, errPutItem = writeAudited(dynaClient, "CreateNewUser", userTableName, userInfo.UserId, write,
+			func(map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+				return inputItemValue
+			})
+	} else {
+		putOutput, errPutItem = dynaClient.PutItem(input)
+	}
+	recordCall("CreateNewUser", userTableName, start, errPutItem)
 	if errPutItem != nil {
+		if _, open := errPutItem.(*CircuitOpenError); open {
+			opLogger.Warn("CircuitOpen", "error", errPutItem.Error(), "durationMs", sinceMs(start))
+			return user, errPutItem
+		}
+		if awsErr, ok := errPutItem.(awserr.Error); ok && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			opLogger.Warn("UserAlreadyExists", "durationMs", sinceMs(start))
+			return user, &UserExistsError{UserID: userInfo.UserId}
+		}
 		errorString := "Put Item Error" + "[" + errPutItem.Error() + "]"
-		fmt.Println(errorString)
+		opLogger.Error("Put Item Error", "error", errPutItem.Error(), "durationMs", sinceMs(start))
 		return user, errors.New(errorString)
 	}
-	fmt.Println("User : " + user.UserId + " Created Successfully")
-	return user, nil
+	recordCapacity("CreateNewUser", userTableName, putOutput.ConsumedCapacity)
+	recordItemCount("CreateNewUser", userTableName, 1)
+	opLogger.Info("User Created Successfully", "durationMs", sinceMs(start))
+	publishUserEvent(UserCreated, userInfo.UserId, &userInfo)
+	return userInfo, nil
 }
 
 //UpdateUserInfo in DynamoDB Store Details
 func UpdateUserInfo(userTableName string, userInfo UserInfo) (UserInfo, error) {
 
+	start := time.Now()
+	opLogger := logger().With("operation", "UpdateUserInfo", "table", userTableName, "userId", userInfo.UserId)
+
+	if errValidate := Validate(userInfo); errValidate != nil {
+		opLogger.Warn("ValidationError", "error", errValidate.Error(), "durationMs", sinceMs(start))
+		return userInfo, errValidate
+	}
+
 	region := "us-east-2"
 	awsSession, _ := session.NewSession(&aws.Config{
 		Region: aws.String(region)},
 	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
 
 	dynaClient := dynamodb.New(awsSession)
 
@@ -159,6 +290,8 @@ func UpdateUserInfo(userTableName string, userInfo UserInfo) (UserInfo, error) {
 	type UserInfoUpdate struct {
 		FirstName string `json:":firstName,omitempty"`
 		LastName  string `json:":lastName,omitempty"`
+		UpdatedAt string `json:":updatedAt"`
+		Actor     string `json:":actor"`
 	}
 
 	//RoleInfoKey model
@@ -171,22 +304,25 @@ func UpdateUserInfo(userTableName string, userInfo UserInfo) (UserInfo, error) {
 		UserID string `json:"userId"`
 	}
 
+	userInfo.UpdatedAt = auditTimestamp()
 	updateUserInfo := UserInfoUpdate{
 		FirstName: userInfo.FirstName,
 		LastName:  userInfo.LastName,
+		UpdatedAt: userInfo.UpdatedAt,
+		Actor:     currentActor(),
 	}
 
 	av, KeyErr := dynamodbattribute.MarshalMap(UserInfoKey{UserID: userInfo.UserId})
 	if KeyErr != nil {
 		errorString := "FailedTableLookupError" + "[" + KeyErr.Error() + "]"
-		fmt.Println(errorString)
+		opLogger.Error("FailedTableLookupError", "error", KeyErr.Error(), "durationMs", sinceMs(start))
 		return userInfo, errors.New(errorString)
 	}
 
 	updateDetails, errUpdateDetails := dynamodbattribute.MarshalMap(updateUserInfo)
 	if errUpdateDetails != nil {
 		errorString := "FailedToCreateUpdateDetails" + "[" + errUpdateDetails.Error() + "]"
-		fmt.Println(errorString)
+		opLogger.Error("FailedToCreateUpdateDetails", "error", errUpdateDetails.Error(), "durationMs", sinceMs(start))
 		return userInfo, errors.New(errorString)
 	}
 
@@ -194,27 +330,70 @@ func UpdateUserInfo(userTableName string, userInfo UserInfo) (UserInfo, error) {
 		Key:       av,
 		TableName: aws.String(userTableName),
 		// ExpressionAttributeNames:  map[string]*string{"#role": aws.String("role")},
-		UpdateExpression:          aws.String("set firstName = :firstName, lastName = :lastName"),
+		// Users created by the update get the creation fields too
+		UpdateExpression: aws.String("set firstName = :firstName, lastName = :lastName, updatedAt = :updatedAt, " +
+			"createdAt = if_not_exists(createdAt, :updatedAt), createdBy = if_not_exists(createdBy, :actor)"),
 		ExpressionAttributeValues: updateDetails,
+		ReturnConsumedCapacity:    aws.String(dynamodb.ReturnConsumedCapacityTotal),
 	}
 
-	_, errUpdateItem := dynaClient.UpdateItem(input)
+	// With an audit table the update and its audit entry are written in one transaction
+	updateOutput := &dynamodb.UpdateItemOutput{}
+	var errUpdateItem error
+	if currentAuditTable() != "" {
+		_, updateOutput.ConsumedCapacity, errUpdateItem = writeAudited(dynaClient, "UpdateUserInfo", userTableName, userInfo.UserId, transactUpdate(input),
+			func(before map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+				changes := map[string]interface{}{"userId": userInfo.UserId, "firstName": userInfo.FirstName, "lastName": userInfo.LastName, "updatedAt": userInfo.UpdatedAt}
+				if before["createdAt"] == nil {
+					changes["createdAt"] = userInfo.UpdatedAt
+				}
+				if before["createdBy"] == nil {
+					changes["createdBy"] = updateUserInfo.Actor
+				}
+				return auditImage(before, changes)
+			})
+	} else {
+		updateOutput, errUpdateItem = dynaClient.UpdateItem(input)
+	}
+	recordCall("UpdateUserInfo", userTableName, start, errUpdateItem)
 	if errUpdateItem != nil {
+		if _, open := errUpdateItem.(*CircuitOpenError); open {
+			opLogger.Warn("CircuitOpen", "error", errUpdateItem.Error(), "durationMs", sinceMs(start))
+			return userInfo, errUpdateItem
+		}
 		errorString := "UpdateItemError" + "[" + errUpdateItem.Error() + "]"
-		fmt.Println(errorString)
+		opLogger.Error("UpdateItemError", "error", errUpdateItem.Error(), "durationMs", sinceMs(start))
 		return userInfo, errors.New(errorString)
 	}
 
-	fmt.Println("User : " + userInfo.UserId + " Details Updated Successfully")
+	recordCapacity("UpdateUserInfo", userTableName, updateOutput.ConsumedCapacity)
+	recordItemCount("UpdateUserInfo", userTableName, 1)
+	opLogger.Info("User Details Updated Successfully", "durationMs", sinceMs(start))
+	publishUserEvent(UserUpdated, userInfo.UserId, &userInfo)
 	return userInfo, nil
 }
 
 //DeleteUser from the table
 func DeleteUser(userID, userTableName string) error {
+	start := time.Now()
+	opLogger := logger().With("operation", "DeleteUser", "table", userTableName, "userId", userID)
+
+	if currentSoftDeletePolicy().Enabled {
+		return SoftDeleteUser(userID, userTableName)
+	}
+
+	if errValidate := ValidateField("userId", userID, userIDRules); errValidate != nil {
+		opLogger.Warn("ValidationError", "error", errValidate.Error(), "durationMs", sinceMs(start))
+		return errValidate
+	}
+
 	region := "us-east-2"
 	awsSession, _ := session.NewSession(&aws.Config{
 		Region: aws.String(region)},
 	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
 
 	dynaClient := dynamodb.New(awsSession)
 
@@ -222,14 +401,33 @@ func DeleteUser(userID, userTableName string) error {
 	itemKeyValue := dynamodb.AttributeValue{S: aws.String(userID)}
 	keys["userId"] = &itemKeyValue
 
-	deleteItemInput := dynamodb.DeleteItemInput{TableName: aws.String(userTableName), Key: keys}
-	_, errFromDelete := dynaClient.DeleteItem(&deleteItemInput)
+	deleteItemInput := dynamodb.DeleteItemInput{TableName: aws.String(userTableName), Key: keys, ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal)}
+	// With an audit table the delete and its audit entry are written in one transaction
+	deleteOutput := &dynamodb.DeleteItemOutput{}
+	var errFromDelete error
+	if currentAuditTable() != "" {
+		write := &dynamodb.TransactWriteItem{Delete: &dynamodb.Delete{Key: keys, TableName: aws.String(userTableName)}}
+		_, deleteOutput.ConsumedCapacity, errFromDelete = writeAudited(dynaClient, "DeleteUser", userTableName, userID, write,
+			func(map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+				return nil
+			})
+	} else {
+		deleteOutput, errFromDelete = dynaClient.DeleteItem(&deleteItemInput)
+	}
+	recordCall("DeleteUser", userTableName, start, errFromDelete)
 	if errFromDelete != nil {
+		if _, open := errFromDelete.(*CircuitOpenError); open {
+			opLogger.Warn("CircuitOpen", "error", errFromDelete.Error(), "durationMs", sinceMs(start))
+			return errFromDelete
+		}
 		errorString := "Failed to Delete" + "[" + errFromDelete.Error() + "]"
-		fmt.Println(errorString)
+		opLogger.Error("Failed to Delete", "error", errFromDelete.Error(), "durationMs", sinceMs(start))
 		return errors.New(errorString)
 	}
-	fmt.Println("User : " + userID + " Deleted Successfully")
+	recordCapacity("DeleteUser", userTableName, deleteOutput.ConsumedCapacity)
+	recordItemCount("DeleteUser", userTableName, 1)
+	opLogger.Info("User Deleted Successfully", "durationMs", sinceMs(start))
+	publishUserEvent(UserDeleted, userID, nil)
 	return nil
 }
 
@@ -238,51 +436,138 @@ func DeleteUser(userID, userTableName string) error {
 type UserInfoAdvanced struct {
 
 	// User Id  user primary key
-	UserId string `json:"userId,omitempty"`
+	UserId string `json:"userId,omitempty" validate:"required,max=128,format=id"`
 
 	// First name of the logged user
-	FirstName string `json:"firstName,omitempty"`
+	FirstName string `json:"firstName,omitempty" validate:"max=64,chars=name"`
 
 	// Last name of the logged user
-	LastName string `json:"lastName,omitempty"`
+	LastName string `json:"lastName,omitempty" validate:"max=64,chars=name"`
 
 	// BatchID
-	BatchID string `json:"batchId,omitempty"`
+	BatchID string `json:"batchId,omitempty" validate:"max=64,format=id"`
 
 	//Group Index created for this "groupIndex"
-	Group string `json:"group,omitempty"`
+	Group string `json:"group,omitempty" validate:"max=64,format=id"`
 
 	//Active sort key
-	Active string `json:"active,omitempty"`
+	Active string `json:"active,omitempty" validate:"oneof=true|false"`
+
+	// Set when first written
+	CreatedAt string `json:"createdAt,omitempty"`
+
+	// Set on every write
+	UpdatedAt string `json:"updatedAt,omitempty"`
+
+	// Actor that created the user, see SetActor
+	CreatedBy string `json:"createdBy,omitempty"`
+
+	// Set by SoftDeleteUser, reads skip the user while set
+	DeletedAt string `json:"deletedAt,omitempty"`
+
+	// Epoch seconds the table TTL deletes the user at, never when zero. See TTLAfter and SetUserTTL
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+}
+
+//Values of the active parameter of GetAdvancedUsersPage and GetListedUberStoresPage
+const (
+	ActiveUsers   = "true"
+	InactiveUsers = "false"
+	AnyUsers      = "any"
+)
+
+//UserPage of a paginated query
+type UserPage struct {
+	Users []UserInfoAdvanced `json:"users"`
+
+	// Cursor of the next page, empty on the last page
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+//groupKeyCondition on "groupIndex", the group alone for AnyUsers. Empty active is ActiveUsers
+func groupKeyCondition(group, active string) expression.KeyConditionBuilder {
+	keyCondition := expression.Key("group").Equal(expression.Value(group))
+	switch active {
+	case AnyUsers:
+		return keyCondition
+	case "":
+		active = ActiveUsers
+	}
+	return keyCondition.And(expression.Key("active").Equal(expression.Value(active)))
+}
+
+//advancedProjection of the UserInfoAdvanced attributes returned by the group and store queries
+func advancedProjection() expression.ProjectionBuilder {
+	return expression.NamesList(expression.Name("userId"), expression.Name("firstName"), expression.Name("lastName"),
+		expression.Name("batchId"), expression.Name("group"), expression.Name("active"),
+		expression.Name("createdAt"), expression.Name("updatedAt"), expression.Name("createdBy"),
+		expression.Name("deletedAt"), expression.Name(ttlAttribute))
 }
 
-//GetStores Details based on filter, index and sort key
+//GetStores Details based on filter, index and sort key: the active users of the group and batch,
+//read through every page of GetAdvancedUsersPage
 func GetAdvancedUsers(group, batch string) ([]UserInfoAdvanced, error) {
 	users := []UserInfoAdvanced{}
+	page := Page{}
+	for {
+		result, err := GetAdvancedUsersPage(group, batch, ActiveUsers, page)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, result.Users...)
+		if result.NextCursor == "" {
+			return users, nil
+		}
+		page.Cursor = result.NextCursor
+	}
+}
+
+//GetAdvancedUsersPage of the users of the group and batch. active is ActiveUsers, InactiveUsers or
+//AnyUsers. page.Limit bounds the items read per call, so a page can hold fewer users
+func GetAdvancedUsersPage(group, batch, active string, page Page) (UserPage, error) {
+	result := UserPage{Users: []UserInfoAdvanced{}}
 	tableName := ""
+	start := time.Now()
+	opLogger := logger().With("operation", "GetAdvancedUsers", "table", tableName, "group", group, "batchId", batch, "active", active)
+
+	errValidate := ValidateField("group", group, groupRules)
+	if errValidate == nil {
+		errValidate = ValidateField("batchId", batch, batchRules)
+	}
+	if errValidate == nil {
+		errValidate = ValidateField("active", active, activeRules)
+	}
+	if errValidate != nil {
+		opLogger.Warn("ValidationError", "error", errValidate.Error(), "durationMs", sinceMs(start))
+		return result, errValidate
+	}
+	startKey, errCursor := decodeKeyCursor(page.Cursor)
+	if errCursor != nil {
+		opLogger.Warn("ValidationError", "error", errCursor.Error(), "durationMs", sinceMs(start))
+		return result, errCursor
+	}
 
 	region := "us-east-2"
 	awsSession, _ := session.NewSession(&aws.Config{
 		Region: aws.String(region)},
 	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
 
 	dynaClient := dynamodb.New(awsSession)
 
 	//To filter based on the batchID , filters can be any field other than primary key, sort key and index
 	filterBatch := expression.Name("batchId").Equal(expression.Value(batch))
 
-	//Required field to be avilable in the results
-
-	proj := expression.NamesList(expression.Name("userId"), expression.Name("firstName"), expression.Name("lastName"),
-		expression.Name("batchId"), expression.Name("group"), expression.Name("active"))
 	expr, errExpression := expression.NewBuilder().
-		WithFilter(filterBatch).
-		WithProjection(proj).
+		WithKeyCondition(groupKeyCondition(group, active)).
+		WithFilter(filterBatch.And(readable())).
+		WithProjection(advancedProjection()).
 		Build()
 	if errExpression != nil {
-		errorString := "Query Expression Error" + errExpression.Error()
-		fmt.Println(errorString)
-		return users, errExpression
+		opLogger.Error("Query Expression Error", "error", errExpression.Error(), "durationMs", sinceMs(start))
+		return result, errExpression
 	}
 
 	var queryInput = &dynamodb.QueryInput{
@@ -290,51 +575,44 @@ func GetAdvancedUsers(group, batch string) ([]UserInfoAdvanced, error) {
 		ExpressionAttributeValues: expr.Values(),
 		TableName:                 aws.String(tableName),
 		IndexName:                 aws.String("groupIndex"),
-		KeyConditions: map[string]*dynamodb.Condition{ //Only can add sort key, primary key or created index (GSI)
-			"group": {
-				ComparisonOperator: aws.String("EQ"),
-				AttributeValueList: []*dynamodb.AttributeValue{
-					{
-						S: aws.String(group),
-					},
-				},
-			},
-			"active": {
-				ComparisonOperator: aws.String("EQ"),
-				AttributeValueList: []*dynamodb.AttributeValue{
-					{
-						S: aws.String("true"),
-					},
-				},
-			},
-		},
-		FilterExpression:     expr.Filter(),
-		ProjectionExpression: expr.Projection(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+		ExclusiveStartKey:         startKey,
+		ReturnConsumedCapacity:    aws.String(dynamodb.ReturnConsumedCapacityTotal),
+	}
+	if page.Limit > 0 {
+		queryInput.Limit = aws.Int64(page.Limit)
 	}
 
 	var resp, errQueryDynamoDB = dynaClient.Query(queryInput)
+	recordCall("GetAdvancedUsers", tableName, start, errQueryDynamoDB)
 	if errQueryDynamoDB != nil {
-		errorString := "FailedTableLookupError" + errQueryDynamoDB.Error()
-		fmt.Println(errorString)
-		return users, errQueryDynamoDB
+		opLogger.Error("FailedTableLookupError", "error", errQueryDynamoDB.Error(), "durationMs", sinceMs(start))
+		return result, errQueryDynamoDB
 	}
+	recordCapacity("GetAdvancedUsers", tableName, resp.ConsumedCapacity)
+	recordItemCount("GetAdvancedUsers", tableName, len(resp.Items))
 
-	if len(resp.Items) > 0 {
-		errUnMarshal := dynamodbattribute.UnmarshalListOfMaps(resp.Items, &users)
-		if errUnMarshal != nil {
-			errorString := "UnMarshal users Error" + errUnMarshal.Error()
-			fmt.Println(errorString)
-			return users, errUnMarshal
-		}
-	} else {
+	errUnMarshal := dynamodbattribute.UnmarshalListOfMaps(resp.Items, &result.Users)
+	if errUnMarshal != nil {
+		opLogger.Error("UnMarshal users Error", "error", errUnMarshal.Error(), "durationMs", sinceMs(start))
+		return result, errUnMarshal
+	}
+	if len(resp.LastEvaluatedKey) > 0 {
+		result.NextCursor = encodeKeyCursor(resp.LastEvaluatedKey)
+	}
+
+	// Only an empty first and last page means nothing matched, a filtered page can be empty
+	if len(result.Users) == 0 && page.Cursor == "" && result.NextCursor == "" {
 		errorString := "Stores Not found for Group: " + group + "BatchID : " + batch
-		fmt.Println(errorString)
-		return users, errors.New(errorString)
+		opLogger.Warn("Users Not found for group and batch", "durationMs", sinceMs(start))
+		return result, errors.New(errorString)
 	}
 
-	fmt.Println("Successfully Fetched " + strconv.FormatInt(*resp.Count, 10) + " results from DynamoDB for group: " + group)
+	opLogger.Info("Successfully Fetched", "count", len(result.Users), "more", result.NextCursor != "", "durationMs", sinceMs(start))
 
-	return users, nil
+	return result, nil
 }
 
 //GetListedUserss results of given primary key list (Max 100)
@@ -342,11 +620,21 @@ func GetListedUserss(userIDs []string) ([]UserInfoAdvanced, error) {
 
 	users := []UserInfoAdvanced{}
 	tableName := ""
+	start := time.Now()
+	opLogger := logger().With("operation", "GetListedUserss", "table", tableName, "requested", len(userIDs))
+
+	if errValidate := validateList("userIds", userIDs, userIDRules, maxBatchGetKeys); errValidate != nil {
+		opLogger.Warn("ValidationError", "error", errValidate.Error(), "durationMs", sinceMs(start))
+		return users, errValidate
+	}
 
 	region := "us-east-2"
 	awsSession, _ := session.NewSession(&aws.Config{
 		Region: aws.String(region)},
 	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
 
 	dynaClient := dynamodb.New(awsSession)
 
@@ -369,110 +657,111 @@ func GetListedUserss(userIDs []string) ([]UserInfoAdvanced, error) {
 				Keys: keys,
 			},
 		},
+		ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
 	}
 
 	var resp, errQueryDynamoDB = dynaClient.BatchGetItem(queryInput)
+	recordCall("GetListedUserss", tableName, start, errQueryDynamoDB)
 	if errQueryDynamoDB != nil {
-		errorString := "FailedTableLookupError" + errQueryDynamoDB.Error()
-		fmt.Println(errorString)
+		opLogger.Error("FailedTableLookupError", "error", errQueryDynamoDB.Error(), "durationMs", sinceMs(start))
 		return users, errQueryDynamoDB
 	}
+	recordCapacity("GetListedUserss", tableName, resp.ConsumedCapacity...)
+	recordItemCount("GetListedUserss", tableName, len(resp.Responses[tableName]))
 
-	if len(resp.Responses[tableName]) > 0 {
-		errUnMarshal := dynamodbattribute.UnmarshalListOfMaps(resp.Responses[tableName], &users)
-		if errUnMarshal != nil {
-			errorString := "UnMarshal Error" + errUnMarshal.Error()
-			fmt.Println(errorString)
-			return users, errUnMarshal
+	errUnMarshal := dynamodbattribute.UnmarshalListOfMaps(resp.Responses[tableName], &users)
+	if errUnMarshal != nil {
+		opLogger.Error("UnMarshal Error", "error", errUnMarshal.Error(), "durationMs", sinceMs(start))
+		return users, errUnMarshal
+	}
+
+	//Soft deleted and expired users are skipped
+	found := users[:0]
+	for _, user := range users {
+		if user.DeletedAt == "" && !isExpired(user.ExpiresAt) {
+			found = append(found, user)
 		}
-	} else {
+	}
+	users = found
+
+	if len(users) == 0 {
 		errorString := "Users Not found for the input list of ID's"
-		fmt.Println(errorString)
+		opLogger.Warn("Users Not found for the input list of ID's", "durationMs", sinceMs(start))
 		return users, errors.New(errorString)
 	}
 
-	fmt.Println("Successfully Fetched " + strconv.Itoa(len(users)) + " results from DynamoDB")
+	opLogger.Info("Successfully Fetched", "count", len(users), "durationMs", sinceMs(start))
 	return users, nil
 }
 
-//GetListed non primary key
+//GetListed non primary key: the active users of the group among the store IDs, all of them in
+//one GetListedUberStoresPage
 func GetListedUberStores(storeIDs []string, group string) ([]UserInfoAdvanced, error) {
-	users := []UserInfoAdvanced{}
+	result, err := GetListedUberStoresPage(storeIDs, group, ActiveUsers, Page{})
+	return result.Users, err
+}
+
+//GetListedUberStoresPage of the users of the group among the store IDs, active as in
+//GetAdvancedUsersPage. The store IDs (Max 1000) are looked up in one filtered read of the group,
+//or with concurrent queries of the first name index when set, see SetFirstNameIndex. The users
+//are de-duplicated and paged by userId. Every page repeats the whole lookup, the cursor only
+//skips users already returned and saves no reads
+func GetListedUberStoresPage(storeIDs []string, group, active string, page Page) (UserPage, error) {
+	result := UserPage{Users: []UserInfoAdvanced{}}
 	tableName := ""
+	start := time.Now()
+	opLogger := logger().With("operation", "GetListedUberStores", "table", tableName, "group", group, "active", active, "requested", len(storeIDs))
+
+	errValidate := ValidateField("group", group, groupRules)
+	if errValidate == nil {
+		errValidate = ValidateField("active", active, activeRules)
+	}
+	if errValidate == nil {
+		errValidate = validateList("storeIds", storeIDs, storeIDRules, maxLookupValues)
+	}
+	if errValidate == nil {
+		_, errValidate = decodeStringCursor(page.Cursor)
+	}
+	if errValidate != nil {
+		opLogger.Warn("ValidationError", "error", errValidate.Error(), "durationMs", sinceMs(start))
+		return result, errValidate
+	}
 
 	region := "us-east-2"
 	awsSession, _ := session.NewSession(&aws.Config{
 		Region: aws.String(region)},
 	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
 
 	dynaClient := dynamodb.New(awsSession)
 
-	filterBatch := expression.Name("firstName").Equal(expression.Value(storeIDs[0]))
-
-	for i := 1; i < len(storeIDs); i++ {
-		filterBatch = filterBatch.Or(expression.Name("firstName").Equal(expression.Value(storeIDs[i])))
-	}
-
-	proj := expression.NamesList(expression.Name("userId"), expression.Name("firstName"), expression.Name("lastName"),
-		expression.Name("batchId"), expression.Name("group"), expression.Name("active"))
-	expr, errExpression := expression.NewBuilder().
-		WithFilter(filterBatch).
-		WithProjection(proj).
-		Build()
+	queries, errExpression := storeQueries(tableName, uniqueValues(storeIDs), group, active)
 	if errExpression != nil {
-		errorString := "Query Expression Error" + errExpression.Error()
-		fmt.Println(errorString)
-		return users, errExpression
-	}
-
-	var queryInput = &dynamodb.QueryInput{
-		ExpressionAttributeNames:  expr.Names(),
-		ExpressionAttributeValues: expr.Values(),
-		TableName:                 aws.String(tableName),
-		IndexName:                 aws.String("groupIndex"),
-		KeyConditions: map[string]*dynamodb.Condition{
-			"group": {
-				ComparisonOperator: aws.String("EQ"),
-				AttributeValueList: []*dynamodb.AttributeValue{
-					{
-						S: aws.String(group),
-					},
-				},
-			},
-			"active": {
-				ComparisonOperator: aws.String("EQ"),
-				AttributeValueList: []*dynamodb.AttributeValue{
-					{
-						S: aws.String("true"),
-					},
-				},
-			},
-		},
-		FilterExpression:     expr.Filter(),
-		ProjectionExpression: expr.Projection(),
+		opLogger.Error("Query Expression Error", "error", errExpression.Error(), "durationMs", sinceMs(start))
+		return result, errExpression
 	}
 
-	var resp, errQueryDynamoDB = dynaClient.Query(queryInput)
+	users, errQueryDynamoDB := lookupUsers(dynaClient, "GetListedUberStores", tableName, queries)
 	if errQueryDynamoDB != nil {
-		errorString := "FailedTableLookupError" + errQueryDynamoDB.Error()
-		fmt.Println(errorString)
-		return users, errQueryDynamoDB
+		if _, open := errQueryDynamoDB.(*CircuitOpenError); open {
+			opLogger.Warn("CircuitOpen", "error", errQueryDynamoDB.Error(), "durationMs", sinceMs(start))
+			return result, errQueryDynamoDB
+		}
+		opLogger.Error("FailedTableLookupError", "error", errQueryDynamoDB.Error(), "queries", len(queries), "durationMs", sinceMs(start))
+		return result, errQueryDynamoDB
 	}
+	recordItemCount("GetListedUberStores", tableName, len(users))
 
-	if len(resp.Items) > 0 {
-		errUnMarshal := dynamodbattribute.UnmarshalListOfMaps(resp.Items, &users)
-		if errUnMarshal != nil {
-			errorString := "UnMarshal  Error" + errUnMarshal.Error()
-			fmt.Println(errorString)
-			return users, errUnMarshal
-		}
-	} else {
+	if len(users) == 0 {
 		errorString := "Stores Not found for group: " + group + " in the input list of ID's"
-		fmt.Println(errorString)
-		return users, errors.New(errorString)
+		opLogger.Warn("Stores Not found for group in the input list of ID's", "durationMs", sinceMs(start))
+		return result, errors.New(errorString)
 	}
 
-	fmt.Println("Successfully Fetched " + strconv.FormatInt(*resp.Count, 10) + " results from DynamoDB for Pos Org ID: " + group)
+	result, _ = pageUsers(users, page)
+	opLogger.Info("Successfully Fetched", "count", len(result.Users), "queries", len(queries), "more", result.NextCursor != "", "durationMs", sinceMs(start))
 
-	return users, nil
+	return result, nil
 }
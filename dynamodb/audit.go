@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+)
+
+//AuditTableEnv names the audit table, mutations are not audited when unset
+const AuditTableEnv = "AUDIT_TABLE"
+
+//maxAuditAttempts of a mutation conflicting with concurrent writes to the same user
+const maxAuditAttempts = 3
+
+//auditTimeLayout sorts lexically in time order, unlike RFC3339Nano which trims zeros
+const auditTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+//AuditEntry recorded with every mutation, in a table with the "userId" string partition key and
+//the "entryKey" string sort key
+type AuditEntry struct {
+	UserId string `json:"userId"`
+
+	// <timestamp>#<entryId>, orders the history of a user
+	EntryKey string `json:"entryKey"`
+
+	EntryID   string `json:"entryId"`
+	Timestamp string `json:"timestamp"`
+
+	// Repository function that made the change, e.g. "UpdateUserInfo"
+	Operation string `json:"operation"`
+	TableName string `json:"tableName"`
+	Actor     string `json:"actor,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+
+	// Item before and after the change, nil when it did not exist
+	Before map[string]interface{} `json:"before,omitempty"`
+	After  map[string]interface{} `json:"after,omitempty"`
+}
+
+var (
+	auditTableMu   sync.RWMutex
+	auditTableName = os.Getenv(AuditTableEnv)
+)
+
+//SetAuditTable mutations are recorded in, an empty name disables auditing
+func SetAuditTable(tableName string) {
+	auditTableMu.Lock()
+	defer auditTableMu.Unlock()
+	auditTableName = tableName
+}
+
+func currentAuditTable() string {
+	auditTableMu.RLock()
+	defer auditTableMu.RUnlock()
+	return auditTableName
+}
+
+//writeAudited applies the write in one transaction with an audit entry of the user's before and
+//after images. after derives the after image from the before image, nil when deleted.
+//The write only succeeds if the user is unchanged since it was read, conflicts are retried
+func writeAudited(client dynamodbiface.DynamoDBAPI, operation, tableName, userID string, write *dynamodb.TransactWriteItem,
+	after func(before map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, *dynamodb.ConsumedCapacity, error) {
+
+	keys := map[string]*dynamodb.AttributeValue{"userId": {S: aws.String(userID)}}
+
+	for attempt := 1; ; attempt++ {
+		getItemInput := dynamodb.GetItemInput{TableName: aws.String(tableName), Key: keys, ConsistentRead: aws.Bool(true)}
+		response, errFromLookup := client.GetItem(&getItemInput)
+		if errFromLookup != nil {
+			return nil, nil, errFromLookup
+		}
+		before := response.Item
+		afterImage := after(before)
+
+		entry, errEntry := newAuditEntry(operation, tableName, userID, before, afterImage)
+		if errEntry != nil {
+			return nil, nil, errEntry
+		}
+		guarded, errGuard := guardUnchanged(write, before)
+		if errGuard != nil {
+			return nil, nil, errGuard
+		}
+
+		input := &dynamodb.TransactWriteItemsInput{
+			TransactItems: []*dynamodb.TransactWriteItem{
+				guarded,
+				{Put: &dynamodb.Put{
+					TableName:           aws.String(currentAuditTable()),
+					Item:                entry,
+					ConditionExpression: aws.String("attribute_not_exists(entryKey)"),
+				}},
+			},
+			ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+		}
+		output, errTransact := client.TransactWriteItems(input)
+		if errTransact == nil {
+			var capacity *dynamodb.ConsumedCapacity
+			for _, tableCapacity := range output.ConsumedCapacity {
+				if aws.StringValue(tableCapacity.TableName) == tableName {
+					capacity = tableCapacity
+				}
+			}
+			return afterImage, capacity, nil
+		}
+
+		canceled, ok := errTransact.(*dynamodb.TransactionCanceledException)
+		if !ok || len(canceled.CancellationReasons) == 0 || aws.StringValue(canceled.CancellationReasons[0].Code) != "ConditionalCheckFailed" {
+			return nil, nil, errTransact
+		}
+
+		// The condition of the write itself failed unless the user changed since it was read
+		current, errFromLookup := client.GetItem(&getItemInput)
+		if errFromLookup != nil {
+			return nil, nil, errFromLookup
+		}
+		if sameVersion(before, current.Item) {
+			return nil, nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", errTransact)
+		}
+		if attempt == maxAuditAttempts {
+			return nil, nil, errors.New("AuditConflictError" + ": " + userID + " changed concurrently")
+		}
+		logger().Warn("AuditConflict", "operation", operation, "table", tableName, "userId", userID, "attempt", attempt)
+	}
+}
+
+//transactUpdate of an UpdateItem input
+func transactUpdate(input *dynamodb.UpdateItemInput) *dynamodb.TransactWriteItem {
+	return &dynamodb.TransactWriteItem{Update: &dynamodb.Update{
+		Key:                       input.Key,
+		TableName:                 input.TableName,
+		UpdateExpression:          input.UpdateExpression,
+		ConditionExpression:       input.ConditionExpression,
+		ExpressionAttributeNames:  input.ExpressionAttributeNames,
+		ExpressionAttributeValues: input.ExpressionAttributeValues,
+	}}
+}
+
+//guardUnchanged adds the condition that the user is still at the version read to a copy of write
+func guardUnchanged(write *dynamodb.TransactWriteItem, before map[string]*dynamodb.AttributeValue) (*dynamodb.TransactWriteItem, error) {
+
+	// Placeholders are fixed, those of expression builders are numbered and cannot clash
+	guard := "#auditVersion = :auditVersion"
+	names := map[string]*string{"#auditVersion": aws.String("updatedAt")}
+	values := map[string]*dynamodb.AttributeValue{}
+	switch {
+	case before == nil:
+		guard = "attribute_not_exists(#auditKey)"
+		names = map[string]*string{"#auditKey": aws.String("userId")}
+	case before["updatedAt"] == nil:
+		guard = "attribute_not_exists(#auditVersion)"
+	default:
+		values[":auditVersion"] = before["updatedAt"]
+	}
+
+	guarded := *write
+	var condition **string
+	var writeNames *map[string]*string
+	var writeValues *map[string]*dynamodb.AttributeValue
+	switch {
+	case write.Put != nil:
+		put := *write.Put
+		guarded.Put = &put
+		condition, writeNames, writeValues = &put.ConditionExpression, &put.ExpressionAttributeNames, &put.ExpressionAttributeValues
+	case write.Update != nil:
+		update := *write.Update
+		guarded.Update = &update
+		condition, writeNames, writeValues = &update.ConditionExpression, &update.ExpressionAttributeNames, &update.ExpressionAttributeValues
+	case write.Delete != nil:
+		deleteItem := *write.Delete
+		guarded.Delete = &deleteItem
+		condition, writeNames, writeValues = &deleteItem.ConditionExpression, &deleteItem.ExpressionAttributeNames, &deleteItem.ExpressionAttributeValues
+	default:
+		return nil, errors.New("UnsupportedAuditedWrite")
+	}
+
+	if existing := aws.StringValue(*condition); existing != "" {
+		guard = "(" + existing + ") AND (" + guard + ")"
+	}
+	*condition = aws.String(guard)
+	for name, value := range *writeNames {
+		names[name] = value
+	}
+	*writeNames = names
+	for name, value := range *writeValues {
+		values[name] = value
+	}
+	if len(values) > 0 {
+		*writeValues = values
+	}
+	return &guarded, nil
+}
+
+func sameVersion(before, current map[string]*dynamodb.AttributeValue) bool {
+	if before == nil || current == nil {
+		return before == nil && current == nil
+	}
+	if before["updatedAt"] == nil || current["updatedAt"] == nil {
+		return before["updatedAt"] == nil && current["updatedAt"] == nil
+	}
+	return aws.StringValue(before["updatedAt"].S) == aws.StringValue(current["updatedAt"].S)
+}
+
+func newAuditEntry(operation, tableName, userID string, before, after map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+
+	now := time.Now().UTC()
+	entry := AuditEntry{
+		UserId:    userID,
+		EntryID:   newEventID(),
+		Timestamp: now.Format(time.RFC3339Nano),
+		Operation: operation,
+		TableName: tableName,
+		Actor:     currentActor(),
+		RequestID: currentRequestID(),
+	}
+	entry.EntryKey = now.Format(auditTimeLayout) + "#" + entry.EntryID
+
+	if before != nil {
+		if errUnmarshal := dynamodbattribute.UnmarshalMap(before, &entry.Before); errUnmarshal != nil {
+			return nil, errUnmarshal
+		}
+	}
+	if after != nil {
+		if errUnmarshal := dynamodbattribute.UnmarshalMap(after, &entry.After); errUnmarshal != nil {
+			return nil, errUnmarshal
+		}
+	}
+	return dynamodbattribute.MarshalMap(entry)
+}
+
+//auditImage of an item after setting and removing attributes of before
+func auditImage(before map[string]*dynamodb.AttributeValue, set map[string]interface{}, remove ...string) map[string]*dynamodb.AttributeValue {
+	image := make(map[string]*dynamodb.AttributeValue, len(before)+len(set))
+	for name, value := range before {
+		image[name] = value
+	}
+	for name, value := range set {
+		if marshaled, err := dynamodbattribute.Marshal(value); err == nil {
+			image[name] = marshaled
+		}
+	}
+	for _, name := range remove {
+		delete(image, name)
+	}
+	return image
+}
+
+//GetUserHistory returns the audit entries of the user, oldest first
+func GetUserHistory(userID string) ([]AuditEntry, error) {
+
+	start := time.Now()
+	tableName := currentAuditTable()
+	opLogger := logger().With("operation", "GetUserHistory", "table", tableName, "userId", userID)
+
+	entries := []AuditEntry{}
+	if errValidate := ValidateField("userId", userID, userIDRules); errValidate != nil {
+		opLogger.Warn("ValidationError", "error", errValidate.Error(), "durationMs", sinceMs(start))
+		return entries, errValidate
+	}
+	if tableName == "" {
+		opLogger.Error("AuditTableNotSet", "durationMs", sinceMs(start))
+		return entries, errors.New("AuditTableNotSet" + ": " + AuditTableEnv)
+	}
+
+	region := "us-east-2"
+	awsSession, _ := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
+
+	dynaClient := dynamodb.New(awsSession)
+
+	keyCondition := expression.Key("userId").Equal(expression.Value(userID))
+	expr, errExpression := expression.NewBuilder().WithKeyCondition(keyCondition).Build()
+	if errExpression != nil {
+		opLogger.Error("Query Expression Error", "error", errExpression.Error(), "durationMs", sinceMs(start))
+		return entries, errExpression
+	}
+
+	var queryInput = &dynamodb.QueryInput{
+		TableName:                 aws.String(tableName),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ScanIndexForward:          aws.Bool(true),
+		ReturnConsumedCapacity:    aws.String(dynamodb.ReturnConsumedCapacityTotal),
+	}
+
+	var errUnMarshal error
+	errQueryDynamoDB := dynaClient.QueryPages(queryInput, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		recordCapacity("GetUserHistory", tableName, page.ConsumedCapacity)
+		var pageEntries []AuditEntry
+		if errUnMarshal = dynamodbattribute.UnmarshalListOfMaps(page.Items, &pageEntries); errUnMarshal != nil {
+			return false
+		}
+		entries = append(entries, pageEntries...)
+		return true
+	})
+	recordCall("GetUserHistory", tableName, start, errQueryDynamoDB)
+	if errQueryDynamoDB != nil {
+		opLogger.Error("FailedTableLookupError", "error", errQueryDynamoDB.Error(), "durationMs", sinceMs(start))
+		return entries, errQueryDynamoDB
+	}
+	if errUnMarshal != nil {
+		opLogger.Error("UnMarshal Audit Entries Error", "error", errUnMarshal.Error(), "durationMs", sinceMs(start))
+		return entries, errUnMarshal
+	}
+
+	recordItemCount("GetUserHistory", tableName, len(entries))
+	opLogger.Info("Successfully Fetched", "count", len(entries), "durationMs", sinceMs(start))
+	return entries, nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+//Environment variables configuring the circuit breakers of AWS services
+const (
+	BreakerFailureRateEnv = "BREAKER_FAILURE_RATE"
+	BreakerMinRequestsEnv = "BREAKER_MIN_REQUESTS"
+	BreakerWindowEnv      = "BREAKER_WINDOW"
+	BreakerOpenTimeoutEnv = "BREAKER_OPEN_TIMEOUT"
+)
+
+//Circuit breaker states, also the value of the "CircuitState" metric
+const (
+	CircuitClosed   = 0
+	CircuitHalfOpen = 1
+	CircuitOpen     = 2
+)
+
+//CircuitOpenError returned without calling the service while its circuit is open
+type CircuitOpenError struct {
+	Service string
+
+	// Time until the circuit half-opens
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return "CircuitOpen: " + e.Service + " unavailable, retry after " + e.RetryAfter.String()
+}
+
+//Code, Message and OrigErr make it an awserr.Error, so it is classified like SDK errors
+func (e *CircuitOpenError) Code() string { return "CircuitOpen" }
+
+func (e *CircuitOpenError) Message() string { return e.Error() }
+
+func (e *CircuitOpenError) OrigErr() error { return nil }
+
+//BreakerSettings of a CircuitBreaker
+type BreakerSettings struct {
+
+	// Share of failed calls in the window opening the circuit, 0.5 when zero
+	FailureRate float64
+
+	// Calls in the window before the failure rate is considered, 10 when zero
+	MinRequests int
+
+	// Window the failure rate is counted over, 30s when zero
+	Window time.Duration
+
+	// Time the circuit stays open before a probe call is let through, 15s when zero
+	OpenTimeout time.Duration
+}
+
+//BreakerSettingsFromEnv reads the BREAKER_* variables, durations as accepted by time.ParseDuration
+func BreakerSettingsFromEnv() BreakerSettings {
+	settings := BreakerSettings{}
+	if value, err := strconv.ParseFloat(os.Getenv(BreakerFailureRateEnv), 64); err == nil {
+		settings.FailureRate = value
+	}
+	if value, err := strconv.Atoi(os.Getenv(BreakerMinRequestsEnv)); err == nil {
+		settings.MinRequests = value
+	}
+	if value, err := time.ParseDuration(os.Getenv(BreakerWindowEnv)); err == nil {
+		settings.Window = value
+	}
+	if value, err := time.ParseDuration(os.Getenv(BreakerOpenTimeoutEnv)); err == nil {
+		settings.OpenTimeout = value
+	}
+	return settings
+}
+
+//CircuitBreaker stops calling a service once its failure rate crosses the threshold. After
+//OpenTimeout a single probe call is let through, closing the circuit on success
+type CircuitBreaker struct {
+	Service  string
+	Settings BreakerSettings
+
+	mu          sync.Mutex
+	state       int
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probing     bool
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = make(map[string]*CircuitBreaker)
+)
+
+//BreakerFor the service, shared by every session of the process
+func BreakerFor(service string) *CircuitBreaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	breaker, ok := breakers[service]
+	if !ok {
+		breaker = &CircuitBreaker{Service: service, Settings: BreakerSettingsFromEnv()}
+		breakers[service] = breaker
+	}
+	return breaker
+}
+
+//breakSession guards the requests made by clients of the session with the breaker of their service
+func breakSession(awsSession *session.Session) {
+	if awsSession == nil {
+		return
+	}
+	awsSession.Handlers.Validate.PushBackNamed(request.NamedHandler{Name: "breaker.Allow", Fn: func(r *request.Request) {
+		if errOpen := BreakerFor(r.ClientInfo.ServiceName).Allow(); errOpen != nil {
+			r.Error = errOpen
+			return
+		}
+		r.SetContext(context.WithValue(r.Context(), breakerCallKey{}, &breakerCall{}))
+	}})
+	awsSession.Handlers.Send.PushFrontNamed(request.NamedHandler{Name: "breaker.Sent", Fn: func(r *request.Request) {
+		if call, ok := r.Context().Value(breakerCallKey{}).(*breakerCall); ok {
+			call.sent = true
+		}
+	}})
+
+	// Only requests sent to the service are recorded. One allowed but failing before it is
+	// sent, e.g. on parameter validation, gives back its half open probe
+	awsSession.Handlers.Complete.PushBackNamed(request.NamedHandler{Name: "breaker.Record", Fn: func(r *request.Request) {
+		call, ok := r.Context().Value(breakerCallKey{}).(*breakerCall)
+		if !ok {
+			return
+		}
+		if call.sent {
+			BreakerFor(r.ClientInfo.ServiceName).Record(r.Error)
+		} else {
+			BreakerFor(r.ClientInfo.ServiceName).release()
+		}
+	}})
+}
+
+//breakerCallKey of the breakerCall in the context of requests allowed by the breaker
+type breakerCallKey struct{}
+
+type breakerCall struct {
+	sent bool
+}
+
+//Do calls fn unless the circuit is open, recording its outcome
+func (b *CircuitBreaker) Do(fn func() error) error {
+	if errOpen := b.Allow(); errOpen != nil {
+		return errOpen
+	}
+	err := fn()
+	b.Record(err)
+	return err
+}
+
+//State of the circuit
+func (b *CircuitBreaker) State() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+//Allow a call, or return a CircuitOpenError while the circuit is open or probing
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	settings := b.Settings.withDefaults()
+
+	switch b.state {
+	case CircuitOpen:
+		if wait := settings.OpenTimeout - time.Since(b.openedAt); wait > 0 {
+			return b.reject(wait)
+		}
+		b.transition(CircuitHalfOpen)
+		b.probing = true
+		return nil
+	case CircuitHalfOpen:
+		if b.probing {
+			return b.reject(0)
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+//Record the outcome of an allowed call. Only throttling, server side and connection errors count
+//as failures, client errors such as a failed condition mean the service is healthy
+func (b *CircuitBreaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	settings := b.Settings.withDefaults()
+	failed := err != nil && DefaultRetryable(err)
+
+	if b.state == CircuitHalfOpen {
+		b.probing = false
+		if failed {
+			b.openedAt = time.Now()
+			b.transition(CircuitOpen)
+		} else {
+			b.resetWindow()
+			b.transition(CircuitClosed)
+		}
+		return
+	}
+
+	if time.Since(b.windowStart) > settings.Window {
+		b.resetWindow()
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+	if b.state == CircuitClosed && b.requests >= settings.MinRequests &&
+		float64(b.failures)/float64(b.requests) >= settings.FailureRate {
+		b.openedAt = time.Now()
+		b.transition(CircuitOpen)
+	}
+}
+
+//release the probe of an allowed call that was not made
+func (b *CircuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitHalfOpen {
+		b.probing = false
+	}
+}
+
+func (b *CircuitBreaker) resetWindow() {
+	b.windowStart = time.Now()
+	b.requests = 0
+	b.failures = 0
+}
+
+func (b *CircuitBreaker) reject(retryAfter time.Duration) error {
+	putMetric("ShortCircuited", 1, UnitCount, map[string]string{"Service": b.Service})
+	return &CircuitOpenError{Service: b.Service, RetryAfter: retryAfter}
+}
+
+//transition to state, emitting the "CircuitState" metric
+func (b *CircuitBreaker) transition(state int) {
+	if b.state != state {
+		logger().Warn("CircuitStateChanged", "operation", "CircuitBreaker", "service", b.Service, "from", b.state, "to", state, "failures", b.failures, "requests", b.requests)
+	}
+	b.state = state
+	putMetric("CircuitState", float64(state), UnitCount, map[string]string{"Service": b.Service})
+}
+
+func (s BreakerSettings) withDefaults() BreakerSettings {
+	if s.FailureRate <= 0 {
+		s.FailureRate = 0.5
+	}
+	if s.MinRequests <= 0 {
+		s.MinRequests = 10
+	}
+	if s.Window <= 0 {
+		s.Window = 30 * time.Second
+	}
+	if s.OpenTimeout <= 0 {
+		s.OpenTimeout = 15 * time.Second
+	}
+	return s
+}
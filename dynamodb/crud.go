@@ -1,43 +1,68 @@
-
 package main
 
 import (
 	"errors"
-	"fmt"
-	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
 )
 
 func main() {
 
-	fmt.Println(GetAllUsers(""))
+	users, err := GetAllUsers("")
+	logger().Info("GetAllUsers", "users", users, "error", err)
+	FlushMetrics()
+	FlushTraces()
 }
 
 //Table Structure
 type UserInfo struct {
 
-	// UserId  
-	UserId string `json:"userId,omitempty"`
+	// UserId
+	UserId string `json:"userId,omitempty" validate:"required,max=128,format=id"`
+
+	// First name
+	FirstName string `json:"firstName,omitempty" validate:"max=64,chars=name"`
+
+	// Last name
+	LastName string `json:"lastName,omitempty" validate:"max=64,chars=name"`
 
-	// First name 
-	FirstName string `json:"firstName,omitempty"`
+	// Set by CreateNewUser
+	CreatedAt string `json:"createdAt,omitempty"`
 
-	// Last name 
-	LastName string `json:"lastName,omitempty"`
+	// Set by CreateNewUser and UpdateUserInfo
+	UpdatedAt string `json:"updatedAt,omitempty"`
+
+	// Actor that created the user, see SetActor
+	CreatedBy string `json:"createdBy,omitempty"`
+
+	// Set by SoftDeleteUser, reads skip the user while set
+	DeletedAt string `json:"deletedAt,omitempty"`
 }
 
 //GetUser details
 func GetUser(tableName, userID string) (UserInfo, error) {
 
+	start := time.Now()
+	opLogger := logger().With("operation", "GetUser", "table", tableName, "userId", userID)
+
 	var userInfo UserInfo
+	if errValidate := ValidateField("userId", userID, userIDRules); errValidate != nil {
+		opLogger.Warn("ValidationError", "error", errValidate.Error(), "durationMs", sinceMs(start))
+		return userInfo, errValidate
+	}
 	region := "us-east-2"
 	awsSession, _ := session.NewSession(&aws.Config{
 		Region: aws.String(region)},
 	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
 
 	dynaClient := dynamodb.New(awsSession)
 
@@ -46,27 +71,40 @@ func GetUser(tableName, userID string) (UserInfo, error) {
 	//Primary key
 	keys["userId"] = &itemKeyValue
 
-	getItemInput := dynamodb.GetItemInput{TableName: aws.String(tableName), Key: keys}
+	getItemInput := dynamodb.GetItemInput{TableName: aws.String(tableName), Key: keys, ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal)}
 	response, errFromLookup := dynaClient.GetItem(&getItemInput)
+	recordCall("GetUser", tableName, start, errFromLookup)
 	if errFromLookup != nil {
+		if _, open := errFromLookup.(*CircuitOpenError); open {
+			opLogger.Warn("CircuitOpen", "error", errFromLookup.Error(), "durationMs", sinceMs(start))
+			return userInfo, errFromLookup
+		}
 		errorString := "FailedTableLookupError" + "[" + errFromLookup.Error() + "]"
-		fmt.Println(errorString)
+		opLogger.Error("FailedTableLookupError", "error", errFromLookup.Error(), "durationMs", sinceMs(start))
 		return userInfo, errors.New(errorString)
 	}
+	recordCapacity("GetUser", tableName, response.ConsumedCapacity)
 	if response.Item == nil {
+		recordItemCount("GetUser", tableName, 0)
 		errorString := "UserNotFound" + ": " + userID
-		fmt.Println(errorString)
+		opLogger.Warn("UserNotFound", "durationMs", sinceMs(start))
 		return userInfo, errors.New(errorString)
 	}
 
 	errFromItemUnmarshal := dynamodbattribute.UnmarshalMap(response.Item, &userInfo)
 	if errFromItemUnmarshal != nil {
 		errorString := "ItemUnMarshalError" + ": " + userID
-		fmt.Println(errorString)
+		opLogger.Error("ItemUnMarshalError", "error", errFromItemUnmarshal.Error(), "durationMs", sinceMs(start))
 		return userInfo, errors.New(errorString)
 	}
+	if userInfo.DeletedAt != "" || itemExpired(response.Item) {
+		errorString := "UserNotFound" + ": " + userID
+		opLogger.Warn("UserNotFound", "deletedAt", userInfo.DeletedAt, "durationMs", sinceMs(start))
+		return UserInfo{}, errors.New(errorString)
+	}
 
-	fmt.Println(" User details of userID : " + userID + " Fetched Successfully")
+	recordItemCount("GetUser", tableName, 1)
+	opLogger.Info("User details Fetched Successfully", "durationMs", sinceMs(start))
 
 	return userInfo, nil
 }
@@ -74,51 +112,96 @@ func GetUser(tableName, userID string) (UserInfo, error) {
 //GetAllUsers Details
 func GetAllUsers(tableName string) ([]UserInfo, error) {
 
+	start := time.Now()
+	opLogger := logger().With("operation", "GetAllUsers", "table", tableName)
+
 	users := []UserInfo{}
 	region := "us-east-2"
 	awsSession, _ := session.NewSession(&aws.Config{
 		Region: aws.String(region)},
 	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
 
 	dynaClient := dynamodb.New(awsSession)
 
+	//Soft deleted and expired users are skipped
+	expr, errExpression := expression.NewBuilder().
+		WithFilter(readable()).
+		Build()
+	if errExpression != nil {
+		opLogger.Error("Query Expression Error", "error", errExpression.Error(), "durationMs", sinceMs(start))
+		return users, errExpression
+	}
+
 	var queryInput = &dynamodb.ScanInput{
-		TableName: aws.String(tableName),
+		TableName:                 aws.String(tableName),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnConsumedCapacity:    aws.String(dynamodb.ReturnConsumedCapacityTotal),
 	}
 
-	var resp, errQueryDynamoDB = dynaClient.Scan(queryInput)
+	// The filter is applied per page, so pages up to the last can hold no readable user
+	var errUnMarshal error
+	errQueryDynamoDB := dynaClient.ScanPages(queryInput, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		recordCapacity("GetAllUsers", tableName, page.ConsumedCapacity)
+		var pageUsers []UserInfo
+		if errUnMarshal = dynamodbattribute.UnmarshalListOfMaps(page.Items, &pageUsers); errUnMarshal != nil {
+			return false
+		}
+		users = append(users, pageUsers...)
+		return true
+	})
+	recordCall("GetAllUsers", tableName, start, errQueryDynamoDB)
 	if errQueryDynamoDB != nil {
-		errorString := "Failed to Lookup table" + errQueryDynamoDB.Error()
-		fmt.Println(errorString)
+		opLogger.Error("Failed to Lookup table", "error", errQueryDynamoDB.Error(), "durationMs", sinceMs(start))
 		return users, errQueryDynamoDB
 	}
+	if errUnMarshal != nil {
+		opLogger.Error("UnMarshal Stores Error", "error", errUnMarshal.Error(), "durationMs", sinceMs(start))
+		return users, errUnMarshal
+	}
+	recordItemCount("GetAllUsers", tableName, len(users))
 
-	if len(resp.Items) > 0 {
-		errUnMarshal := dynamodbattribute.UnmarshalListOfMaps(resp.Items, &users)
-		if errUnMarshal != nil {
-			errorString := "UnMarshal Stores Error" + errUnMarshal.Error()
-			fmt.Println(errorString)
-			return users, errUnMarshal
-		}
-	} else {
+	if len(users) == 0 {
 		errorString := "Users Not found"
-		fmt.Println(errorString)
+		opLogger.Warn("Users Not found", "durationMs", sinceMs(start))
 		return users, errors.New(errorString)
 	}
 
-	fmt.Println("Successfully Fetched " + strconv.FormatInt(*resp.Count, 10))
+	opLogger.Info("Successfully Fetched", "count", len(users), "durationMs", sinceMs(start))
 
 	return users, nil
 }
 
 //CreateNewUser
 func CreateNewUser(userTableName string, userInfo UserInfo) (UserInfo, error) {
+	start := time.Now()
+	opLogger := logger().With("operation", "CreateNewUser", "table", userTableName, "userId", userInfo.UserId)
+
 	var user UserInfo
+	if userInfo.UserId == "" {
+		userInfo.UserId = NewUserID()
+		opLogger = opLogger.With("userId", userInfo.UserId)
+	}
+	userInfo.CreatedAt = auditTimestamp()
+	userInfo.UpdatedAt = userInfo.CreatedAt
+	userInfo.CreatedBy = currentActor()
+
+	if errValidate := Validate(userInfo); errValidate != nil {
+		opLogger.Warn("ValidationError", "error", errValidate.Error(), "durationMs", sinceMs(start))
+		return user, errValidate
+	}
 
 	region := "us-east-2"
 	awsSession, _ := session.NewSession(&aws.Config{
 		Region: aws.String(region)},
 	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
 
 	dynaClient := dynamodb.New(awsSession)
 
@@ -126,32 +209,80 @@ func CreateNewUser(userTableName string, userInfo UserInfo) (UserInfo, error) {
 	inputItemValue, errMarshalMap := dynamodbattribute.MarshalMap(userInfo)
 	if errMarshalMap != nil {
 		errorString := "Marshal Map Error" + "[" + errMarshalMap.Error() + "]"
-		fmt.Println(errorString)
+		opLogger.Error("Marshal Map Error", "error", errMarshalMap.Error(), "durationMs", sinceMs(start))
 		return user, errors.New(errorString)
 	}
 
+	// A readable user is never replaced, its createdAt and createdBy are kept by UpdateUserInfo.
+	// The ID of a soft deleted or expired user can be taken by a new one
+	expr, errExpression := expression.NewBuilder().
+		WithCondition(creatable()).
+		Build()
+	if errExpression != nil {
+		opLogger.Error("Query Expression Error", "error", errExpression.Error(), "durationMs", sinceMs(start))
+		return user, errExpression
+	}
 	input := &dynamodb.PutItemInput{
-		Item:      inputItemValue,
-		TableName: aws.String(userTableName),
+		Item:                      inputItemValue,
+		TableName:                 aws.String(userTableName),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnConsumedCapacity:    aws.String(dynamodb.ReturnConsumedCapacityTotal),
 	}
 
-	_, errPutItem := dynaClient.PutItem(input)
+	// With an audit table the put and its audit entry are written in one transaction
+	putOutput := &dynamodb.PutItemOutput{}
+	var errPutItem error
+	if currentAuditTable() != "" {
+		write := &dynamodb.TransactWriteItem{Put: &dynamodb.Put{Item: inputItemValue, TableName: aws.String(userTableName),
+			ConditionExpression: input.ConditionExpression, ExpressionAttributeNames: input.ExpressionAttributeNames, ExpressionAttributeValues: input.ExpressionAttributeValues}}
+		_, putOutput.ConsumedCapacity, errPutItem = writeAudited(dynaClient, "CreateNewUser", userTableName, userInfo.UserId, write,
+			func(map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+				return inputItemValue
+			})
+	} else {
+		putOutput, errPutItem = dynaClient.PutItem(input)
+	}
+	recordCall("CreateNewUser", userTableName, start, errPutItem)
 	if errPutItem != nil {
+		if _, open := errPutItem.(*CircuitOpenError); open {
+			opLogger.Warn("CircuitOpen", "error", errPutItem.Error(), "durationMs", sinceMs(start))
+			return user, errPutItem
+		}
+		if awsErr, ok := errPutItem.(awserr.Error); ok && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			opLogger.Warn("UserAlreadyExists", "durationMs", sinceMs(start))
+			return user, &UserExistsError{UserID: userInfo.UserId}
+		}
 		errorString := "Put Item Error" + "[" + errPutItem.Error() + "]"
-		fmt.Println(errorString)
+		opLogger.Error("Put Item Error", "error", errPutItem.Error(), "durationMs", sinceMs(start))
 		return user, errors.New(errorString)
 	}
-	fmt.Println("User : " + user.UserId + " Created Successfully")
-	return user, nil
+	recordCapacity("CreateNewUser", userTableName, putOutput.ConsumedCapacity)
+	recordItemCount("CreateNewUser", userTableName, 1)
+	opLogger.Info("User Created Successfully", "durationMs", sinceMs(start))
+	publishUserEvent(UserCreated, userInfo.UserId, &userInfo)
+	return userInfo, nil
 }
 
 //UpdateUserInfo in DynamoDB Store Details
 func UpdateUserInfo(userTableName string, userInfo UserInfo) (UserInfo, error) {
 
+	start := time.Now()
+	opLogger := logger().With("operation", "UpdateUserInfo", "table", userTableName, "userId", userInfo.UserId)
+
+	if errValidate := Validate(userInfo); errValidate != nil {
+		opLogger.Warn("ValidationError", "error", errValidate.Error(), "durationMs", sinceMs(start))
+		return userInfo, errValidate
+	}
+
 	region := "us-east-2"
 	awsSession, _ := session.NewSession(&aws.Config{
 		Region: aws.String(region)},
 	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
 
 	dynaClient := dynamodb.New(awsSession)
 
@@ -159,6 +290,8 @@ func UpdateUserInfo(userTableName string, userInfo UserInfo) (UserInfo, error) {
 	type UserInfoUpdate struct {
 		FirstName string `json:":firstName,omitempty"`
 		LastName  string `json:":lastName,omitempty"`
+		UpdatedAt string `json:":updatedAt"`
+		Actor     string `json:":actor"`
 	}
 
 	//RoleInfoKey model
@@ -171,22 +304,25 @@ func UpdateUserInfo(userTableName string, userInfo UserInfo) (UserInfo, error) {
 		UserID string `json:"userId"`
 	}
 
+	userInfo.UpdatedAt = auditTimestamp()
 	updateUserInfo := UserInfoUpdate{
 		FirstName: userInfo.FirstName,
 		LastName:  userInfo.LastName,
+		UpdatedAt: userInfo.UpdatedAt,
+		Actor:     currentActor(),
 	}
 
 	av, KeyErr := dynamodbattribute.MarshalMap(UserInfoKey{UserID: userInfo.UserId})
 	if KeyErr != nil {
 		errorString := "FailedTableLookupError" + "[" + KeyErr.Error() + "]"
-		fmt.Println(errorString)
+		opLogger.Error("FailedTableLookupError", "error", KeyErr.Error(), "durationMs", sinceMs(start))
 		return userInfo, errors.New(errorString)
 	}
 
 	updateDetails, errUpdateDetails := dynamodbattribute.MarshalMap(updateUserInfo)
 	if errUpdateDetails != nil {
 		errorString := "FailedToCreateUpdateDetails" + "[" + errUpdateDetails.Error() + "]"
-		fmt.Println(errorString)
+		opLogger.Error("FailedToCreateUpdateDetails", "error", errUpdateDetails.Error(), "durationMs", sinceMs(start))
 		return userInfo, errors.New(errorString)
 	}
 
@@ -194,27 +330,70 @@ func UpdateUserInfo(userTableName string, userInfo UserInfo) (UserInfo, error) {
 		Key:       av,
 		TableName: aws.String(userTableName),
 		// ExpressionAttributeNames:  map[string]*string{"#role": aws.String("role")},
-		UpdateExpression:          aws.String("set firstName = :firstName, lastName = :lastName"),
+		// Users created by the update get the creation fields too
+		UpdateExpression: aws.String("set firstName = :firstName, lastName = :lastName, updatedAt = :updatedAt, " +
+			"createdAt = if_not_exists(createdAt, :updatedAt), createdBy = if_not_exists(createdBy, :actor)"),
 		ExpressionAttributeValues: updateDetails,
+		ReturnConsumedCapacity:    aws.String(dynamodb.ReturnConsumedCapacityTotal),
 	}
 
-	_, errUpdateItem := dynaClient.UpdateItem(input)
+	// With an audit table the update and its audit entry are written in one transaction
+	updateOutput := &dynamodb.UpdateItemOutput{}
+	var errUpdateItem error
+	if currentAuditTable() != "" {
+		_, updateOutput.ConsumedCapacity, errUpdateItem = writeAudited(dynaClient, "UpdateUserInfo", userTableName, userInfo.UserId, transactUpdate(input),
+			func(before map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+				changes := map[string]interface{}{"userId": userInfo.UserId, "firstName": userInfo.FirstName, "lastName": userInfo.LastName, "updatedAt": userInfo.UpdatedAt}
+				if before["createdAt"] == nil {
+					changes["createdAt"] = userInfo.UpdatedAt
+				}
+				if before["createdBy"] == nil {
+					changes["createdBy"] = updateUserInfo.Actor
+				}
+				return auditImage(before, changes)
+			})
+	} else {
+		updateOutput, errUpdateItem = dynaClient.UpdateItem(input)
+	}
+	recordCall("UpdateUserInfo", userTableName, start, errUpdateItem)
 	if errUpdateItem != nil {
+		if _, open := errUpdateItem.(*CircuitOpenError); open {
+			opLogger.Warn("CircuitOpen", "error", errUpdateItem.Error(), "durationMs", sinceMs(start))
+			return userInfo, errUpdateItem
+		}
 		errorString := "UpdateItemError" + "[" + errUpdateItem.Error() + "]"
-		fmt.Println(errorString)
+		opLogger.Error("UpdateItemError", "error", errUpdateItem.Error(), "durationMs", sinceMs(start))
 		return userInfo, errors.New(errorString)
 	}
 
-	fmt.Println("User : " + userInfo.UserId + " Details Updated Successfully")
+	recordCapacity("UpdateUserInfo", userTableName, updateOutput.ConsumedCapacity)
+	recordItemCount("UpdateUserInfo", userTableName, 1)
+	opLogger.Info("User Details Updated Successfully", "durationMs", sinceMs(start))
+	publishUserEvent(UserUpdated, userInfo.UserId, &userInfo)
 	return userInfo, nil
 }
 
 //DeleteUser from the table
 func DeleteUser(userID, userTableName string) error {
+	start := time.Now()
+	opLogger := logger().With("operation", "DeleteUser", "table", userTableName, "userId", userID)
+
+	if currentSoftDeletePolicy().Enabled {
+		return SoftDeleteUser(userID, userTableName)
+	}
+
+	if errValidate := ValidateField("userId", userID, userIDRules); errValidate != nil {
+		opLogger.Warn("ValidationError", "error", errValidate.Error(), "durationMs", sinceMs(start))
+		return errValidate
+	}
+
 	region := "us-east-2"
 	awsSession, _ := session.NewSession(&aws.Config{
 		Region: aws.String(region)},
 	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
 
 	dynaClient := dynamodb.New(awsSession)
 
@@ -222,13 +401,32 @@ func DeleteUser(userID, userTableName string) error {
 	itemKeyValue := dynamodb.AttributeValue{S: aws.String(userID)}
 	keys["userId"] = &itemKeyValue
 
-	deleteItemInput := dynamodb.DeleteItemInput{TableName: aws.String(userTableName), Key: keys}
-	_, errFromDelete := dynaClient.DeleteItem(&deleteItemInput)
+	deleteItemInput := dynamodb.DeleteItemInput{TableName: aws.String(userTableName), Key: keys, ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal)}
+	// With an audit table the delete and its audit entry are written in one transaction
+	deleteOutput := &dynamodb.DeleteItemOutput{}
+	var errFromDelete error
+	if currentAuditTable() != "" {
+		write := &dynamodb.TransactWriteItem{Delete: &dynamodb.Delete{Key: keys, TableName: aws.String(userTableName)}}
+		_, deleteOutput.ConsumedCapacity, errFromDelete = writeAudited(dynaClient, "DeleteUser", userTableName, userID, write,
+			func(map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+				return nil
+			})
+	} else {
+		deleteOutput, errFromDelete = dynaClient.DeleteItem(&deleteItemInput)
+	}
+	recordCall("DeleteUser", userTableName, start, errFromDelete)
 	if errFromDelete != nil {
+		if _, open := errFromDelete.(*CircuitOpenError); open {
+			opLogger.Warn("CircuitOpen", "error", errFromDelete.Error(), "durationMs", sinceMs(start))
+			return errFromDelete
+		}
 		errorString := "Failed to Delete" + "[" + errFromDelete.Error() + "]"
-		fmt.Println(errorString)
+		opLogger.Error("Failed to Delete", "error", errFromDelete.Error(), "durationMs", sinceMs(start))
 		return errors.New(errorString)
 	}
-	fmt.Println("User : " + userID + " Deleted Successfully")
+	recordCapacity("DeleteUser", userTableName, deleteOutput.ConsumedCapacity)
+	recordItemCount("DeleteUser", userTableName, 1)
+	opLogger.Info("User Deleted Successfully", "durationMs", sinceMs(start))
+	publishUserEvent(UserDeleted, userID, nil)
 	return nil
 }
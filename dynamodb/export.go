@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/parquet-go/parquet-go"
+)
+
+//FormatParquet export format, alongside FormatCSV and FormatJSONLines
+const FormatParquet = "parquet"
+
+//ExportSchema selects the attributes written for every exported item
+type ExportSchema struct {
+	Name    string
+	Columns []string
+}
+
+//Schemas of the user tables
+var (
+	UserInfoSchema = ExportSchema{
+		Name:    "UserInfo",
+		Columns: []string{"userId", "firstName", "lastName", "createdAt", "updatedAt", "createdBy"},
+	}
+	UserInfoAdvancedSchema = ExportSchema{
+		Name:    "UserInfoAdvanced",
+		Columns: []string{"userId", "firstName", "lastName", "batchId", "group", "active", "createdAt", "updatedAt", "createdBy", "expiresAt"},
+	}
+)
+
+//Exporter writes a full scan of a user table to S3.
+//Wire it into a scheduled Lambda with lambda.Start(exporter.Handle)
+type Exporter struct {
+
+	// Table to export, read with paginated scans like GetAllUsers
+	TableName string
+
+	// Destination bucket and key prefix. Objects are written to
+	// <Prefix><TableName>/dt=YYYY-MM-DD/<TableName>-<timestamp>.<format>[.gz]
+	Bucket string
+	Prefix string
+
+	// FormatJSONLines (default), FormatCSV or FormatParquet
+	Format string
+
+	// Columns to export, UserInfoSchema when empty
+	Schema ExportSchema
+
+	// Gzip compresses JSON Lines and CSV objects, and the column chunks of Parquet objects
+	Gzip bool
+
+	// Clients, created from the default region when nil
+	DynamoDB dynamodbiface.DynamoDBAPI
+	S3       s3iface.S3API
+}
+
+//ExportManifest written next to every export
+type ExportManifest struct {
+	Table        string   `json:"table"`
+	Bucket       string   `json:"bucket"`
+	Key          string   `json:"key"`
+	Format       string   `json:"format"`
+	Compression  string   `json:"compression"`
+	Schema       string   `json:"schema"`
+	Columns      []string `json:"columns"`
+	ItemCount    int64    `json:"itemCount"`
+	ScannedCount int64    `json:"scannedCount"`
+	Bytes        int64    `json:"bytes"`
+	SHA256       string   `json:"sha256"`
+	StartedAt    string   `json:"startedAt"`
+	FinishedAt   string   `json:"finishedAt"`
+}
+
+//Handle a scheduled event, partitioning the export by the event time
+func (e *Exporter) Handle(ctx context.Context, event events.CloudWatchEvent) error {
+	SetRequestContext(ctx)
+	defer FlushMetrics()
+	defer FlushTraces()
+
+	exportTime := event.Time
+	if exportTime.IsZero() {
+		exportTime = time.Now()
+	}
+	_, err := e.Export(ctx, exportTime)
+	return err
+}
+
+//Export the table and its manifest, returning the manifest
+func (e *Exporter) Export(ctx context.Context, exportTime time.Time) (ExportManifest, error) {
+
+	start := time.Now()
+	opLogger := logger().With("operation", "Export", "table", e.TableName, "bucket", e.Bucket)
+
+	e.initClients()
+
+	schema := e.Schema
+	if len(schema.Columns) == 0 {
+		schema = UserInfoSchema
+	}
+	format := e.Format
+	if format == "" {
+		format = FormatJSONLines
+	}
+
+	exportTime = exportTime.UTC()
+	manifest := ExportManifest{
+		Table:       e.TableName,
+		Bucket:      e.Bucket,
+		Key:         e.objectKey(exportTime, format),
+		Format:      format,
+		Compression: "none",
+		Schema:      schema.Name,
+		Columns:     schema.Columns,
+		StartedAt:   time.Now().UTC().Format(time.RFC3339),
+	}
+	if e.Gzip {
+		manifest.Compression = "gzip"
+	}
+
+	// The scan is encoded into a pipe read by the multipart uploader
+	pipeReader, pipeWriter := io.Pipe()
+	checksum := sha256.New()
+	counter := &countingWriter{}
+	output := io.MultiWriter(pipeWriter, checksum, counter)
+
+	uploader := s3manager.NewUploaderWithClient(e.S3)
+	uploadDone := make(chan error, 1)
+	go func() {
+		_, errUpload := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+			Bucket:      aws.String(e.Bucket),
+			Key:         aws.String(manifest.Key),
+			Body:        pipeReader,
+			ContentType: aws.String(exportContentType(format)),
+		})
+		pipeReader.CloseWithError(errUpload)
+		uploadDone <- errUpload
+	}()
+
+	errEncode := e.scanInto(ctx, output, format, schema, &manifest)
+	pipeWriter.CloseWithError(errEncode)
+	errUpload := <-uploadDone
+
+	if errEncode != nil {
+		errorString := "ExportError" + ": " + e.TableName + "[" + errEncode.Error() + "]"
+		opLogger.Error("ExportError", "error", errEncode.Error(), "durationMs", sinceMs(start))
+		return manifest, errors.New(errorString)
+	}
+	if errUpload != nil {
+		errorString := "Error while Uploading to S3 Bucket" + "[" + errUpload.Error() + "]"
+		opLogger.Error("Error while Uploading to S3 Bucket", "key", manifest.Key, "error", errUpload.Error(), "durationMs", sinceMs(start))
+		return manifest, errors.New(errorString)
+	}
+
+	manifest.Bytes = counter.count
+	manifest.SHA256 = hex.EncodeToString(checksum.Sum(nil))
+	manifest.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+
+	if errManifest := e.uploadManifest(ctx, manifest); errManifest != nil {
+		return manifest, errManifest
+	}
+
+	opLogger.Info("Successfully Exported", "key", manifest.Key, "count", manifest.ItemCount, "bytes", manifest.Bytes, "durationMs", sinceMs(start))
+	return manifest, nil
+}
+
+func (e *Exporter) initClients() {
+	if e.DynamoDB != nil && e.S3 != nil {
+		return
+	}
+	region := "us-east-2"
+	awsSession, _ := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
+	if e.DynamoDB == nil {
+		e.DynamoDB = dynamodb.New(awsSession)
+	}
+	if e.S3 == nil {
+		e.S3 = s3.New(awsSession)
+	}
+}
+
+func (e *Exporter) objectKey(exportTime time.Time, format string) string {
+	key := e.Prefix + e.TableName + "/dt=" + exportTime.Format("2006-01-02") + "/" +
+		e.TableName + "-" + exportTime.Format("20060102T150405Z") + "." + format
+	if e.Gzip && format != FormatParquet {
+		key += ".gz"
+	}
+	return key
+}
+
+//scanInto pages through the table, encoding every item to output
+func (e *Exporter) scanInto(ctx context.Context, output io.Writer, format string, schema ExportSchema, manifest *ExportManifest) error {
+
+	var compressed *gzip.Writer
+	if e.Gzip && format != FormatParquet {
+		compressed = gzip.NewWriter(output)
+		output = compressed
+	}
+
+	encoder, errEncoder := newRowEncoder(output, format, schema, e.Gzip)
+	if errEncoder != nil {
+		return errEncoder
+	}
+
+	names := make([]expression.NameBuilder, 0, len(schema.Columns))
+	for _, column := range schema.Columns {
+		names = append(names, expression.Name(column))
+	}
+	expr, errExpression := expression.NewBuilder().
+		WithProjection(expression.NamesList(names[0], names[1:]...)).
+		Build()
+	if errExpression != nil {
+		return errors.New("Query Expression Error" + errExpression.Error())
+	}
+
+	var errRow error
+	errScan := e.DynamoDB.ScanPagesWithContext(ctx, &dynamodb.ScanInput{
+		TableName:                aws.String(e.TableName),
+		ExpressionAttributeNames: expr.Names(),
+		ProjectionExpression:     expr.Projection(),
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		manifest.ScannedCount += aws.Int64Value(page.ScannedCount)
+		for _, item := range page.Items {
+			var values map[string]interface{}
+			if errRow = dynamodbattribute.UnmarshalMap(item, &values); errRow != nil {
+				return false
+			}
+			if errRow = encoder.WriteRow(values); errRow != nil {
+				return false
+			}
+			manifest.ItemCount++
+		}
+		return true
+	})
+	if errScan != nil {
+		return errors.New("Failed to Lookup table" + errScan.Error())
+	}
+	if errRow != nil {
+		return errRow
+	}
+
+	if errClose := encoder.Close(); errClose != nil {
+		return errClose
+	}
+	if compressed != nil {
+		return compressed.Close()
+	}
+	return nil
+}
+
+func (e *Exporter) uploadManifest(ctx context.Context, manifest ExportManifest) error {
+
+	payload, errMarshal := json.MarshalIndent(manifest, "", "  ")
+	if errMarshal != nil {
+		errorString := "Marshal Manifest Error" + "[" + errMarshal.Error() + "]"
+		logger().Error("Marshal Manifest Error", "operation", "Export", "table", e.TableName, "error", errMarshal.Error())
+		return errors.New(errorString)
+	}
+
+	s3BucketInput := &s3.PutObjectInput{
+		Body:        aws.ReadSeekCloser(bytes.NewReader(payload)),
+		Bucket:      aws.String(e.Bucket),
+		Key:         aws.String(manifest.Key + ".manifest.json"),
+		ContentType: aws.String("application/json"),
+	}
+
+	_, err := e.S3.PutObjectWithContext(ctx, s3BucketInput)
+	if err != nil {
+		errorString := "Error while Uploading to S3 Bucket" + "[" + err.Error() + "]"
+		logger().Error("Error while Uploading to S3 Bucket", "operation", "Export", "bucket", e.Bucket, "key", manifest.Key+".manifest.json", "error", err.Error())
+		return errors.New(errorString)
+	}
+	return nil
+}
+
+func exportContentType(format string) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv"
+	case FormatParquet:
+		return "application/vnd.apache.parquet"
+	}
+	return "application/x-ndjson"
+}
+
+//rowEncoder writes items restricted to the schema columns
+type rowEncoder interface {
+	WriteRow(values map[string]interface{}) error
+	Close() error
+}
+
+func newRowEncoder(output io.Writer, format string, schema ExportSchema, compress bool) (rowEncoder, error) {
+	switch format {
+	case FormatJSONLines:
+		return &jsonLinesEncoder{encoder: json.NewEncoder(output), columns: schema.Columns}, nil
+	case FormatCSV:
+		encoder := &csvEncoder{writer: csv.NewWriter(output), columns: schema.Columns}
+		return encoder, encoder.writer.Write(schema.Columns)
+	case FormatParquet:
+		return newParquetEncoder(output, schema, compress), nil
+	}
+	return nil, errors.New("UnsupportedExportFormat" + ": " + format)
+}
+
+type jsonLinesEncoder struct {
+	encoder *json.Encoder
+	columns []string
+}
+
+func (j *jsonLinesEncoder) WriteRow(values map[string]interface{}) error {
+	row := make(map[string]interface{}, len(j.columns))
+	for _, column := range j.columns {
+		if value, ok := values[column]; ok {
+			row[column] = value
+		}
+	}
+	return j.encoder.Encode(row)
+}
+
+func (j *jsonLinesEncoder) Close() error {
+	return nil
+}
+
+type csvEncoder struct {
+	writer  *csv.Writer
+	columns []string
+}
+
+func (c *csvEncoder) WriteRow(values map[string]interface{}) error {
+	record := make([]string, len(c.columns))
+	for i, column := range c.columns {
+		record[i] = exportString(values[column])
+	}
+	return c.writer.Write(record)
+}
+
+func (c *csvEncoder) Close() error {
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+//parquetEncoder writes every column as an optional UTF8 string
+type parquetEncoder struct {
+	writer *parquet.Writer
+
+	// Columns in leaf order, parquet groups sort their fields by name
+	columns []string
+}
+
+func newParquetEncoder(output io.Writer, schema ExportSchema, compress bool) *parquetEncoder {
+
+	group := parquet.Group{}
+	for _, column := range schema.Columns {
+		group[column] = parquet.Optional(parquet.String())
+	}
+
+	columns := append([]string{}, schema.Columns...)
+	sort.Strings(columns)
+
+	options := []parquet.WriterOption{parquet.NewSchema(schema.Name, group)}
+	if compress {
+		options = append(options, parquet.Compression(&parquet.Gzip))
+	}
+
+	return &parquetEncoder{writer: parquet.NewWriter(output, options...), columns: columns}
+}
+
+func (p *parquetEncoder) WriteRow(values map[string]interface{}) error {
+	row := make(parquet.Row, len(p.columns))
+	for i, column := range p.columns {
+		value, ok := values[column]
+		if !ok || value == nil {
+			row[i] = parquet.NullValue().Level(0, 0, i)
+			continue
+		}
+		row[i] = parquet.ByteArrayValue([]byte(exportString(value))).Level(0, 1, i)
+	}
+	_, err := p.writer.WriteRows([]parquet.Row{row})
+	return err
+}
+
+func (p *parquetEncoder) Close() error {
+	return p.writer.Close()
+}
+
+//exportString formats an unmarshalled attribute for CSV and Parquet columns
+func exportString(value interface{}) string {
+	switch typed := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return typed
+	case float64:
+		return strconv.FormatFloat(typed, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(typed)
+	}
+	encoded, _ := json.Marshal(value)
+	return strings.TrimSpace(string(encoded))
+}
+
+type countingWriter struct {
+	count int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.count += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+)
+
+//Page of a paginated call. Pass the NextCursor of the previous result to continue
+type Page struct {
+
+	// Maximum number of results, all when zero
+	Limit int64
+
+	// Opaque position to continue from, the first page when empty
+	Cursor string
+}
+
+//GroupPage of ListGroups
+type GroupPage struct {
+	Groups []string `json:"groups"`
+
+	// Cursor of the next page, empty on the last page
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+//BulkProgress reported after every user of a bulk operation
+type BulkProgress struct {
+	Operation string `json:"operation"`
+	Processed int    `json:"processed"`
+	Updated   int    `json:"updated"`
+	Failed    int    `json:"failed"`
+
+	// Users to process, zero while unknown, e.g. during the scan of SetBatchActive
+	Total int `json:"total,omitempty"`
+}
+
+//ProgressFunc receives the progress of a bulk operation
+type ProgressFunc func(progress BulkProgress)
+
+//BulkFailure of one user
+type BulkFailure struct {
+	UserID string `json:"userId"`
+	Reason string `json:"reason"`
+}
+
+//BulkResult of MoveUsersToGroup and SetBatchActive
+type BulkResult struct {
+	BulkProgress
+	Failures []BulkFailure `json:"failures,omitempty"`
+
+	// Cursor to continue SetBatchActive from, empty when the batch is done
+	NextCursor string `json:"nextCursor,omitempty"`
+
+	lastUserID string
+}
+
+func (r *BulkResult) record(userID string, err error, progress ProgressFunc) {
+	r.lastUserID = userID
+	r.Processed++
+	if err != nil {
+		r.Failed++
+		r.Failures = append(r.Failures, BulkFailure{UserID: userID, Reason: err.Error()})
+	} else {
+		r.Updated++
+	}
+	if progress != nil {
+		progress(r.BulkProgress)
+	}
+}
+
+//ListGroups returns the groups with users, sorted by name. Every call scans the whole table for
+//the group attribute, the cursor is the last group of the previous page and only skips groups
+//already returned, so paging saves no reads. Keep a registry of groups, such as the "GROUP#"
+//items of SingleTable, when the table is large
+func ListGroups(tableName string, page Page) (GroupPage, error) {
+
+	start := time.Now()
+	opLogger := logger().With("operation", "ListGroups", "table", tableName, "cursor", page.Cursor)
+
+	result := GroupPage{Groups: []string{}}
+	after, errCursor := decodeStringCursor(page.Cursor)
+	if errCursor != nil {
+		opLogger.Warn("ValidationError", "error", errCursor.Error(), "durationMs", sinceMs(start))
+		return result, errCursor
+	}
+
+	region := "us-east-2"
+	awsSession, _ := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
+
+	dynaClient := dynamodb.New(awsSession)
+
+	expr, errExpression := expression.NewBuilder().
+		WithFilter(expression.AttributeExists(expression.Name("group")).And(readable())).
+		WithProjection(expression.NamesList(expression.Name("group"))).
+		Build()
+	if errExpression != nil {
+		opLogger.Error("Query Expression Error", "error", errExpression.Error(), "durationMs", sinceMs(start))
+		return result, errExpression
+	}
+
+	var queryInput = &dynamodb.ScanInput{
+		TableName:                 aws.String(tableName),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnConsumedCapacity:    aws.String(dynamodb.ReturnConsumedCapacityTotal),
+	}
+
+	groups := map[string]bool{}
+	errQueryDynamoDB := dynaClient.ScanPages(queryInput, func(scanPage *dynamodb.ScanOutput, lastPage bool) bool {
+		recordCapacity("ListGroups", tableName, scanPage.ConsumedCapacity)
+		for _, item := range scanPage.Items {
+			if group := aws.StringValue(item["group"].S); group > after {
+				groups[group] = true
+			}
+		}
+		return true
+	})
+	recordCall("ListGroups", tableName, start, errQueryDynamoDB)
+	if errQueryDynamoDB != nil {
+		if _, open := errQueryDynamoDB.(*CircuitOpenError); open {
+			opLogger.Warn("CircuitOpen", "error", errQueryDynamoDB.Error(), "durationMs", sinceMs(start))
+			return result, errQueryDynamoDB
+		}
+		opLogger.Error("Failed to Lookup table", "error", errQueryDynamoDB.Error(), "durationMs", sinceMs(start))
+		return result, errors.New("FailedTableLookupError" + "[" + errQueryDynamoDB.Error() + "]")
+	}
+
+	for group := range groups {
+		result.Groups = append(result.Groups, group)
+	}
+	sort.Strings(result.Groups)
+	if page.Limit > 0 && int64(len(result.Groups)) > page.Limit {
+		result.Groups = result.Groups[:page.Limit]
+		result.NextCursor = encodeStringCursor(result.Groups[len(result.Groups)-1])
+	}
+
+	recordItemCount("ListGroups", tableName, len(result.Groups))
+	opLogger.Info("Successfully Fetched", "count", len(result.Groups), "durationMs", sinceMs(start))
+	return result, nil
+}
+
+//CountUsersInGroup counts the active and inactive users of the group through "groupIndex"
+func CountUsersInGroup(tableName, group string) (int64, error) {
+
+	start := time.Now()
+	opLogger := logger().With("operation", "CountUsersInGroup", "table", tableName, "group", group)
+
+	if errValidate := ValidateField("group", group, groupRules); errValidate != nil {
+		opLogger.Warn("ValidationError", "error", errValidate.Error(), "durationMs", sinceMs(start))
+		return 0, errValidate
+	}
+
+	region := "us-east-2"
+	awsSession, _ := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
+
+	dynaClient := dynamodb.New(awsSession)
+
+	expr, errExpression := expression.NewBuilder().
+		WithKeyCondition(expression.Key("group").Equal(expression.Value(group))).
+		WithFilter(readable()).
+		Build()
+	if errExpression != nil {
+		opLogger.Error("Query Expression Error", "error", errExpression.Error(), "durationMs", sinceMs(start))
+		return 0, errExpression
+	}
+
+	var queryInput = &dynamodb.QueryInput{
+		TableName:                 aws.String(tableName),
+		IndexName:                 aws.String("groupIndex"),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		Select:                    aws.String(dynamodb.SelectCount),
+		ReturnConsumedCapacity:    aws.String(dynamodb.ReturnConsumedCapacityTotal),
+	}
+
+	var count int64
+	errQueryDynamoDB := dynaClient.QueryPages(queryInput, func(queryPage *dynamodb.QueryOutput, lastPage bool) bool {
+		recordCapacity("CountUsersInGroup", tableName, queryPage.ConsumedCapacity)
+		count += aws.Int64Value(queryPage.Count)
+		return true
+	})
+	recordCall("CountUsersInGroup", tableName, start, errQueryDynamoDB)
+	if errQueryDynamoDB != nil {
+		if _, open := errQueryDynamoDB.(*CircuitOpenError); open {
+			opLogger.Warn("CircuitOpen", "error", errQueryDynamoDB.Error(), "durationMs", sinceMs(start))
+			return 0, errQueryDynamoDB
+		}
+		opLogger.Error("FailedTableLookupError", "error", errQueryDynamoDB.Error(), "durationMs", sinceMs(start))
+		return 0, errors.New("FailedTableLookupError" + "[" + errQueryDynamoDB.Error() + "]")
+	}
+
+	opLogger.Info("Successfully Counted", "count", count, "durationMs", sinceMs(start))
+	return count, nil
+}
+
+//MoveUsersToGroup sets the group of the listed users (Max 100). Users that fail, e.g. deleted
+//ones, are reported in the result and the others are still moved
+func MoveUsersToGroup(tableName string, userIDs []string, group string, progress ProgressFunc) (BulkResult, error) {
+
+	start := time.Now()
+	opLogger := logger().With("operation", "MoveUsersToGroup", "table", tableName, "group", group, "requested", len(userIDs))
+
+	result := BulkResult{BulkProgress: BulkProgress{Operation: "MoveUsersToGroup", Total: len(userIDs)}}
+	errValidate := ValidateField("group", group, groupRules)
+	if errValidate == nil {
+		errValidate = validateList("userIds", userIDs, userIDRules, maxBatchGetKeys)
+	}
+	if errValidate != nil {
+		opLogger.Warn("ValidationError", "error", errValidate.Error(), "durationMs", sinceMs(start))
+		return result, errValidate
+	}
+
+	region := "us-east-2"
+	awsSession, _ := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
+
+	dynaClient := dynamodb.New(awsSession)
+
+	for _, userID := range userIDs {
+		errUpdate := updateUserAttributes(dynaClient, "MoveUsersToGroup", tableName, userID, map[string]interface{}{"group": group})
+		result.record(userID, errUpdate, progress)
+		if _, open := errUpdate.(*CircuitOpenError); open {
+			opLogger.Warn("CircuitOpen", "error", errUpdate.Error(), "processed", result.Processed, "durationMs", sinceMs(start))
+			return result, errUpdate
+		}
+	}
+
+	opLogger.Info("Users Moved", "updated", result.Updated, "failed", result.Failed, "durationMs", sinceMs(start))
+	return result, nil
+}
+
+//batchStopBefore is the remaining invocation time at which SetBatchActive stops
+const batchStopBefore = 15 * time.Second
+
+//SetBatchActive sets "active" of every user of the batch. The table is scanned for the batch,
+//page.Limit bounds the items scanned per call. The call also stops when the deadline of ctx is
+//near, and NextCursor continues a partial run
+func SetBatchActive(ctx context.Context, tableName, batchID string, active bool, page Page, progress ProgressFunc) (BulkResult, error) {
+
+	start := time.Now()
+	opLogger := logger().With("operation", "SetBatchActive", "table", tableName, "batchId", batchID, "active", active)
+
+	result := BulkResult{BulkProgress: BulkProgress{Operation: "SetBatchActive"}}
+	if errValidate := ValidateField("batchId", batchID, batchRules); errValidate != nil {
+		opLogger.Warn("ValidationError", "error", errValidate.Error(), "durationMs", sinceMs(start))
+		return result, errValidate
+	}
+	startKey, errCursor := decodeKeyCursor(page.Cursor)
+	if errCursor != nil {
+		opLogger.Warn("ValidationError", "error", errCursor.Error(), "durationMs", sinceMs(start))
+		return result, errCursor
+	}
+
+	region := "us-east-2"
+	awsSession, _ := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
+
+	dynaClient := dynamodb.New(awsSession)
+
+	expr, errExpression := expression.NewBuilder().
+		WithFilter(expression.Name("batchId").Equal(expression.Value(batchID)).And(readable())).
+		WithProjection(expression.NamesList(expression.Name("userId"))).
+		Build()
+	if errExpression != nil {
+		opLogger.Error("Query Expression Error", "error", errExpression.Error(), "durationMs", sinceMs(start))
+		return result, errExpression
+	}
+
+	var queryInput = &dynamodb.ScanInput{
+		TableName:                 aws.String(tableName),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ExclusiveStartKey:         startKey,
+		ReturnConsumedCapacity:    aws.String(dynamodb.ReturnConsumedCapacityTotal),
+	}
+	if page.Limit > 0 {
+		queryInput.Limit = aws.Int64(page.Limit)
+	}
+
+	// A limited call stops after its first scan page, whose last key is the cursor
+	// Stopping mid page, after at least one user so every call makes progress, the cursor is
+	// the key of the last user processed
+	changes := map[string]interface{}{"active": strconv.FormatBool(active)}
+	var errUpdate error
+	errQueryDynamoDB := dynaClient.ScanPagesWithContext(ctx, queryInput, func(scanPage *dynamodb.ScanOutput, lastPage bool) bool {
+		recordCapacity("SetBatchActiveScan", tableName, scanPage.ConsumedCapacity)
+		for _, item := range scanPage.Items {
+			if deadline, ok := ctx.Deadline(); ok && result.Processed > 0 && time.Until(deadline) < batchStopBefore {
+				result.NextCursor = encodeKeyCursor(map[string]*dynamodb.AttributeValue{"userId": {S: aws.String(result.lastUserID)}})
+				errUpdate = nil
+				return false
+			}
+			userID := aws.StringValue(item["userId"].S)
+			errUpdate = updateUserAttributes(dynaClient, "SetBatchActive", tableName, userID, changes)
+			result.record(userID, errUpdate, progress)
+			if _, open := errUpdate.(*CircuitOpenError); open {
+				return false
+			}
+		}
+		errUpdate = nil
+		if page.Limit > 0 && len(scanPage.LastEvaluatedKey) > 0 {
+			result.NextCursor = encodeKeyCursor(scanPage.LastEvaluatedKey)
+			return false
+		}
+		return true
+	})
+	recordCall("SetBatchActiveScan", tableName, start, errQueryDynamoDB)
+	if errQueryDynamoDB != nil {
+		if _, open := errQueryDynamoDB.(*CircuitOpenError); open {
+			opLogger.Warn("CircuitOpen", "error", errQueryDynamoDB.Error(), "processed", result.Processed, "durationMs", sinceMs(start))
+			return result, errQueryDynamoDB
+		}
+		opLogger.Error("Failed to Lookup table", "error", errQueryDynamoDB.Error(), "processed", result.Processed, "durationMs", sinceMs(start))
+		return result, errors.New("FailedTableLookupError" + "[" + errQueryDynamoDB.Error() + "]")
+	}
+	if errUpdate != nil {
+		opLogger.Warn("CircuitOpen", "error", errUpdate.Error(), "processed", result.Processed, "durationMs", sinceMs(start))
+		return result, errUpdate
+	}
+
+	opLogger.Info("Batch Updated", "updated", result.Updated, "failed", result.Failed, "more", result.NextCursor != "", "durationMs", sinceMs(start))
+	return result, nil
+}
+
+//updateUserAttributes sets the attributes of an existing, not deleted user, audited when an
+//audit table is set
+func updateUserAttributes(client dynamodbiface.DynamoDBAPI, operation, tableName, userID string, changes map[string]interface{}) error {
+
+	start := time.Now()
+	now := auditTimestamp()
+	set := map[string]interface{}{"updatedAt": now}
+	update := expression.Set(expression.Name("updatedAt"), expression.Value(now))
+	for name, value := range changes {
+		set[name] = value
+		update = update.Set(expression.Name(name), expression.Value(value))
+	}
+	expr, errExpression := expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(expression.AttributeExists(expression.Name("userId")).And(notDeleted())).
+		Build()
+	if errExpression != nil {
+		return errExpression
+	}
+
+	keys := make(map[string]*dynamodb.AttributeValue)
+	itemKeyValue := dynamodb.AttributeValue{S: aws.String(userID)}
+	keys["userId"] = &itemKeyValue
+
+	input := &dynamodb.UpdateItemInput{
+		Key:                       keys,
+		TableName:                 aws.String(tableName),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnConsumedCapacity:    aws.String(dynamodb.ReturnConsumedCapacityTotal),
+	}
+
+	updateOutput := &dynamodb.UpdateItemOutput{}
+	var errUpdateItem error
+	if currentAuditTable() != "" {
+		_, updateOutput.ConsumedCapacity, errUpdateItem = writeAudited(client, operation, tableName, userID, transactUpdate(input),
+			func(before map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+				return auditImage(before, set)
+			})
+	} else {
+		updateOutput, errUpdateItem = client.UpdateItem(input)
+	}
+	recordCall(operation, tableName, start, errUpdateItem)
+	if errUpdateItem != nil {
+		if _, open := errUpdateItem.(*CircuitOpenError); open {
+			return errUpdateItem
+		}
+		if awsErr, ok := errUpdateItem.(awserr.Error); ok && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.New("UserNotFound" + ": " + userID)
+		}
+		return errors.New("UpdateItemError" + "[" + errUpdateItem.Error() + "]")
+	}
+	recordCapacity(operation, tableName, updateOutput.ConsumedCapacity)
+	recordItemCount(operation, tableName, 1)
+	publishUserEvent(UserUpdated, userID, nil)
+	return nil
+}
+
+//encodeStringCursor and decodeStringCursor of a cursor that is the last value of the previous page
+func encodeStringCursor(value string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+func decodeStringCursor(cursor string) (string, error) {
+	value, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", errors.New("InvalidCursor" + "[" + err.Error() + "]")
+	}
+	return string(value), nil
+}
+
+//encodeKeyCursor and decodeKeyCursor of a LastEvaluatedKey
+func encodeKeyCursor(key map[string]*dynamodb.AttributeValue) string {
+	var values map[string]interface{}
+	if err := dynamodbattribute.UnmarshalMap(key, &values); err != nil {
+		return ""
+	}
+	encoded, _ := json.Marshal(values)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func decodeKeyCursor(cursor string) (map[string]*dynamodb.AttributeValue, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	encoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	var values map[string]interface{}
+	if err == nil {
+		err = json.Unmarshal(encoded, &values)
+	}
+	if err != nil {
+		return nil, errors.New("InvalidCursor" + "[" + err.Error() + "]")
+	}
+	return dynamodbattribute.MarshalMap(values)
+}
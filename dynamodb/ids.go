@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/oklog/ulid/v2"
+	"github.com/segmentio/ksuid"
+)
+
+//UserIDFormatEnv selects the format of generated user IDs: uuid (default), ulid or ksuid
+const UserIDFormatEnv = "USER_ID_FORMAT"
+
+//Formats of generated user IDs
+const (
+	IDFormatUUID  = "uuid"
+	IDFormatULID  = "ulid"
+	IDFormatKSUID = "ksuid"
+)
+
+var (
+	auditMu sync.RWMutex
+	actor   string
+)
+
+//NewUserID in the format set by USER_ID_FORMAT. ULIDs and KSUIDs sort by creation time
+func NewUserID() string {
+	switch strings.ToLower(os.Getenv(UserIDFormatEnv)) {
+	case IDFormatULID:
+		return ulid.Make().String()
+	case IDFormatKSUID:
+		return ksuid.New().String()
+	}
+	return newEventID()
+}
+
+//UserExistsError returned by CreateNewUser for an ID held by a user that is neither soft deleted nor expired
+type UserExistsError struct {
+	UserID string
+}
+
+func (e *UserExistsError) Error() string {
+	return "UserAlreadyExists" + ": " + e.UserID
+}
+
+//userIDNamespace of the name based IDs of userIDForKey
+var userIDNamespace = []byte("user-command-idempotency-key")
+
+//userIDForKey is a name based UUID (version 5) of the key, the same on every call, so a
+//create retried with the same idempotency key writes the same user
+func userIDForKey(key string) string {
+	hash := sha1.New()
+	hash.Write(userIDNamespace)
+	hash.Write([]byte(key))
+	id := hash.Sum(nil)[:16]
+	id[6] = (id[6] & 0x0f) | 0x50
+	id[8] = (id[8] & 0x3f) | 0x80
+	encoded := hex.EncodeToString(id)
+	return encoded[0:8] + "-" + encoded[8:12] + "-" + encoded[12:16] + "-" + encoded[16:20] + "-" + encoded[20:]
+}
+
+//SetActor recorded as createdBy of the users created afterwards, e.g. the caller identity of
+//the invocation. The Lambda function name is used when empty
+func SetActor(name string) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	actor = name
+}
+
+//currentActor for the createdBy field
+func currentActor() string {
+	auditMu.RLock()
+	defer auditMu.RUnlock()
+	if actor != "" {
+		return actor
+	}
+	return lambdacontext.FunctionName
+}
+
+//auditTimestamp for the createdAt and updatedAt fields
+func auditTimestamp() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+//maxReportedRejections kept in an ImportResult, further rejections are only counted
+const maxReportedRejections = 100
+
+//ImportRequest names the JSON Lines or CSV object to import
+type ImportRequest struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+
+	// DryRun validates every row without writing to the table. Its checkpoints are saved
+	// under their own key, so a dry run resumes like an import and never resumes one
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+//dryRunSuffix of the checkpoint key of dry runs
+const dryRunSuffix = "#dryRun"
+
+//source is the checkpoint key of the request, bucket/key with dryRunSuffix for dry runs
+func (r ImportRequest) source() string {
+	if r.DryRun {
+		return r.Bucket + "/" + r.Key + dryRunSuffix
+	}
+	return r.Bucket + "/" + r.Key
+}
+
+//ImportCheckpoint records how far an import of an object has progressed
+type ImportCheckpoint struct {
+
+	// bucket/key of the imported object, the checkpoint key. Dry runs add "#dryRun"
+	Source string `json:"source"`
+
+	// ETag of the object, an import restarts when the object is replaced
+	ETag string `json:"etag"`
+
+	Format string `json:"format"`
+
+	// CSV header, needed to decode rows when resuming mid file
+	Header []string `json:"header,omitempty"`
+
+	// Offset in the uncompressed object and line number after the last written row
+	ByteOffset int64 `json:"byteOffset"`
+	Line       int   `json:"line"`
+
+	Accepted  int    `json:"accepted"`
+	Rejected  int    `json:"rejected"`
+	Completed bool   `json:"completed"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+//ImportResult returned by every invocation. When Completed is false the Lambda
+//stopped before its deadline and must be invoked again with the same request
+type ImportResult struct {
+	ImportCheckpoint
+	DryRun       bool            `json:"dryRun"`
+	RejectedRows []IngestRowInfo `json:"rejectedRows"`
+}
+
+func (r *ImportResult) accept(row int, userID string) {
+	r.Accepted++
+}
+
+func (r *ImportResult) reject(row int, userID, reason string) {
+	r.Rejected++
+	if len(r.RejectedRows) < maxReportedRejections {
+		r.RejectedRows = append(r.RejectedRows, IngestRowInfo{Row: row, UserId: userID, Status: "rejected", Reason: reason})
+	}
+}
+
+//CheckpointStore persists import checkpoints between invocations
+type CheckpointStore interface {
+
+	// Load the checkpoint of source, found is false when none was saved
+	Load(ctx context.Context, source string) (checkpoint ImportCheckpoint, found bool, err error)
+
+	Save(ctx context.Context, checkpoint ImportCheckpoint) error
+}
+
+//Importer restores or seeds a user table from JSON Lines or CSV objects, such as those
+//written by Exporter. Wire it into a Lambda with lambda.Start(importer.Handle)
+type Importer struct {
+
+	// Table the users are written to
+	TableName string
+
+	// Where progress is saved, the import cannot resume when nil
+	Checkpoints CheckpointStore
+
+	// Remaining invocation time at which the import checkpoints and stops, 15s when zero
+	StopBefore time.Duration
+
+	// Rows between checkpoints, 500 when zero
+	CheckpointEvery int
+
+	// Clients, created from the default region when nil
+	DynamoDB dynamodbiface.DynamoDBAPI
+	S3       s3iface.S3API
+}
+
+//Handle an import request
+func (i *Importer) Handle(ctx context.Context, request ImportRequest) (ImportResult, error) {
+	SetRequestContext(ctx)
+	defer FlushMetrics()
+	defer FlushTraces()
+
+	return i.Import(ctx, request)
+}
+
+//Import the object, resuming from its checkpoint
+func (i *Importer) Import(ctx context.Context, request ImportRequest) (ImportResult, error) {
+
+	start := time.Now()
+	opLogger := logger().With("operation", "Import", "table", i.TableName, "source", request.Bucket+"/"+request.Key, "dryRun", request.DryRun)
+
+	i.initClients()
+
+	result := ImportResult{
+		ImportCheckpoint: ImportCheckpoint{Source: request.source()},
+		DryRun:           request.DryRun,
+		RejectedRows:     []IngestRowInfo{},
+	}
+
+	head, errHead := i.S3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(request.Bucket),
+		Key:    aws.String(request.Key),
+	})
+	if errHead != nil {
+		errorString := "Error while Reading from S3 Bucket" + "[" + errHead.Error() + "]"
+		opLogger.Error("Error while Reading from S3 Bucket", "error", errHead.Error(), "durationMs", sinceMs(start))
+		return result, errors.New(errorString)
+	}
+
+	if i.Checkpoints != nil {
+		checkpoint, found, errLoad := i.Checkpoints.Load(ctx, result.Source)
+		if errLoad != nil {
+			return result, errLoad
+		}
+		if found && checkpoint.ETag == aws.StringValue(head.ETag) {
+			result.ImportCheckpoint = checkpoint
+			if checkpoint.Completed {
+				opLogger.Info("Import already Completed", "durationMs", sinceMs(start))
+				return result, nil
+			}
+			opLogger.Info("Resuming import", "line", checkpoint.Line, "byteOffset", checkpoint.ByteOffset)
+		}
+	}
+	result.ETag = aws.StringValue(head.ETag)
+	result.Format = ingestFormat(request.Key, aws.StringValue(head.ContentType))
+	if result.Format == FormatJSONArray {
+		errorString := "UnsupportedImportFormat" + ": " + request.Key + " is a JSON array, use JSON Lines or CSV"
+		opLogger.Error("UnsupportedImportFormat", "format", result.Format, "durationMs", sinceMs(start))
+		return result, errors.New(errorString)
+	}
+
+	body, errOpen := i.openObject(ctx, request, result.ETag, result.ByteOffset)
+	if errOpen != nil {
+		return result, errOpen
+	}
+	defer body.Close()
+
+	errImport := i.importRows(ctx, body, request, &result)
+	if errImport != nil {
+		errorString := "ImportError" + ": " + result.Source + "[" + errImport.Error() + "]"
+		opLogger.Error("ImportError", "error", errImport.Error(), "line", result.Line, "durationMs", sinceMs(start))
+		return result, errors.New(errorString)
+	}
+
+	if result.Completed {
+		opLogger.Info("Import Completed", "accepted", result.Accepted, "rejected", result.Rejected, "durationMs", sinceMs(start))
+	} else {
+		opLogger.Info("Import Checkpointed", "line", result.Line, "byteOffset", result.ByteOffset, "accepted", result.Accepted, "rejected", result.Rejected, "durationMs", sinceMs(start))
+	}
+	return result, nil
+}
+
+func (i *Importer) initClients() {
+	if i.DynamoDB != nil && i.S3 != nil {
+		return
+	}
+	region := "us-east-2"
+	awsSession, _ := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
+	if i.DynamoDB == nil {
+		i.DynamoDB = dynamodb.New(awsSession)
+	}
+	if i.S3 == nil {
+		i.S3 = s3.New(awsSession)
+	}
+}
+
+//openObject positioned at offset of the uncompressed content. Plain objects are read with a
+//ranged GET, gzip objects are decompressed from the start and skipped forward
+func (i *Importer) openObject(ctx context.Context, request ImportRequest, etag string, offset int64) (io.ReadCloser, error) {
+
+	compressed := strings.HasSuffix(request.Key, ".gz")
+
+	input := &s3.GetObjectInput{
+		Bucket:  aws.String(request.Bucket),
+		Key:     aws.String(request.Key),
+		IfMatch: aws.String(etag),
+	}
+	if offset > 0 && !compressed {
+		input.Range = aws.String("bytes=" + strconv.FormatInt(offset, 10) + "-")
+	}
+
+	object, errGetObject := i.S3.GetObjectWithContext(ctx, input)
+	if errGetObject != nil {
+		errorString := "Error while Reading from S3 Bucket" + "[" + errGetObject.Error() + "]"
+		logger().Error("Error while Reading from S3 Bucket", "operation", "Import", "bucket", request.Bucket, "key", request.Key, "error", errGetObject.Error())
+		return nil, errors.New(errorString)
+	}
+	if !compressed {
+		return object.Body, nil
+	}
+
+	gzipReader, errGzip := gzip.NewReader(object.Body)
+	if errGzip != nil {
+		object.Body.Close()
+		errorString := "GzipError" + ": " + request.Key + "[" + errGzip.Error() + "]"
+		logger().Error("GzipError", "operation", "Import", "bucket", request.Bucket, "key", request.Key, "error", errGzip.Error())
+		return nil, errors.New(errorString)
+	}
+	if _, errSkip := io.CopyN(ioutil.Discard, gzipReader, offset); errSkip != nil {
+		object.Body.Close()
+		errorString := "GzipError" + ": " + request.Key + "[" + errSkip.Error() + "]"
+		logger().Error("GzipError", "operation", "Import", "bucket", request.Bucket, "key", request.Key, "error", errSkip.Error())
+		return nil, errors.New(errorString)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gzipReader, object.Body}, nil
+}
+
+//importRows reads rows until the end of the object or the invocation deadline
+func (i *Importer) importRows(ctx context.Context, body io.Reader, request ImportRequest, result *ImportResult) error {
+
+	rows, errRows := newImportRowReader(body, result)
+	if errRows != nil {
+		return errRows
+	}
+
+	stopBefore := i.StopBefore
+	if stopBefore == 0 {
+		stopBefore = 15 * time.Second
+	}
+	checkpointEvery := i.CheckpointEvery
+	if checkpointEvery == 0 {
+		checkpointEvery = 500
+	}
+
+	writer := &userBatchWriter{ctx: ctx, client: i.DynamoDB, tableName: i.TableName, report: result}
+	sinceCheckpoint := 0
+
+	for {
+		user, errRow, errRead := rows.next()
+		if errRead == io.EOF {
+			break
+		}
+		if errRead != nil {
+			return errRead
+		}
+
+		if errRow == nil {
+			errRow = validateIngestedUser(user)
+		}
+		switch {
+		case errRow != nil:
+			result.reject(rows.line, user.UserId, errRow.Error())
+		case request.DryRun:
+			result.accept(rows.line, user.UserId)
+		default:
+			if errAdd := writer.add(rows.line, user); errAdd != nil {
+				return errAdd
+			}
+		}
+		sinceCheckpoint++
+
+		deadline, hasDeadline := ctx.Deadline()
+		stopping := hasDeadline && time.Until(deadline) < stopBefore
+		if stopping || sinceCheckpoint >= checkpointEvery {
+			if errFlush := writer.flush(); errFlush != nil {
+				return errFlush
+			}
+			result.ByteOffset, result.Line = rows.offset, rows.line
+			if errSave := i.saveCheckpoint(ctx, request, result); errSave != nil {
+				return errSave
+			}
+			sinceCheckpoint = 0
+		}
+		if stopping {
+			return nil
+		}
+	}
+
+	if errFlush := writer.flush(); errFlush != nil {
+		return errFlush
+	}
+	result.ByteOffset, result.Line = rows.offset, rows.line
+	result.Completed = true
+	return i.saveCheckpoint(ctx, request, result)
+}
+
+func (i *Importer) saveCheckpoint(ctx context.Context, request ImportRequest, result *ImportResult) error {
+	if i.Checkpoints == nil {
+		return nil
+	}
+	result.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	return i.Checkpoints.Save(ctx, result.ImportCheckpoint)
+}
+
+//importRowReader decodes rows while tracking the offset and line after the last row read
+type importRowReader struct {
+	format string
+	lines  *bufio.Reader
+	csv    *csv.Reader
+	header []string
+
+	// Offset at which the reader started, csv offsets are relative to it
+	base   int64
+	offset int64
+	line   int
+}
+
+func newImportRowReader(body io.Reader, result *ImportResult) (*importRowReader, error) {
+
+	rows := &importRowReader{format: result.Format, base: result.ByteOffset, offset: result.ByteOffset, line: result.Line}
+	if rows.format != FormatCSV {
+		rows.lines = bufio.NewReaderSize(body, 64*1024)
+		return rows, nil
+	}
+
+	rows.csv = csv.NewReader(body)
+	rows.csv.FieldsPerRecord = -1
+	rows.csv.TrimLeadingSpace = true
+
+	if result.ByteOffset > 0 {
+		rows.header = result.Header
+		return rows, nil
+	}
+
+	header, errHeader := rows.csv.Read()
+	if errHeader != nil {
+		return nil, errors.New("CSVHeaderError" + "[" + errHeader.Error() + "]")
+	}
+	rows.header = header
+	rows.offset = rows.base + rows.csv.InputOffset()
+	rows.line = 1
+	result.Header = header
+	return rows, nil
+}
+
+//next row, errRow reports a row that cannot be decoded and err a failure reading the object
+func (r *importRowReader) next() (user UserInfoAdvanced, errRow error, err error) {
+
+	if r.format == FormatCSV {
+		record, errRead := r.csv.Read()
+		if errRead == io.EOF {
+			return user, nil, io.EOF
+		}
+		if _, ok := errRead.(*csv.ParseError); !ok && errRead != nil {
+			return user, nil, errRead
+		}
+		r.offset = r.base + r.csv.InputOffset()
+		r.line++
+		if errRead != nil {
+			return user, errRead, nil
+		}
+		return csvUser(r.header, record), nil, nil
+	}
+
+	for {
+		text, errRead := r.lines.ReadBytes('\n')
+		if errRead != nil && errRead != io.EOF {
+			return user, nil, errRead
+		}
+		if len(text) == 0 && errRead == io.EOF {
+			return user, nil, io.EOF
+		}
+		r.offset += int64(len(text))
+		r.line++
+
+		text = bytes.TrimSpace(text)
+		if len(text) == 0 {
+			if errRead == io.EOF {
+				return user, nil, io.EOF
+			}
+			continue
+		}
+		return user, json.Unmarshal(text, &user), nil
+	}
+}
+
+//DynamoDBCheckpointStore keeps checkpoints in a table with the "source" string partition key
+type DynamoDBCheckpointStore struct {
+	TableName string
+
+	// Client, created from the default region when nil
+	Client dynamodbiface.DynamoDBAPI
+}
+
+//Load the checkpoint of source
+func (d *DynamoDBCheckpointStore) Load(ctx context.Context, source string) (ImportCheckpoint, bool, error) {
+
+	var checkpoint ImportCheckpoint
+	d.initClient()
+
+	keys := make(map[string]*dynamodb.AttributeValue)
+	itemKeyValue := dynamodb.AttributeValue{S: aws.String(source)}
+	keys["source"] = &itemKeyValue
+
+	getItemInput := dynamodb.GetItemInput{TableName: aws.String(d.TableName), Key: keys, ConsistentRead: aws.Bool(true)}
+	response, errFromLookup := d.Client.GetItemWithContext(ctx, &getItemInput)
+	if errFromLookup != nil {
+		errorString := "FailedTableLookupError" + "[" + errFromLookup.Error() + "]"
+		logger().Error("FailedTableLookupError", "operation", "LoadCheckpoint", "table", d.TableName, "source", source, "error", errFromLookup.Error())
+		return checkpoint, false, errors.New(errorString)
+	}
+	if response.Item == nil {
+		return checkpoint, false, nil
+	}
+
+	errFromItemUnmarshal := dynamodbattribute.UnmarshalMap(response.Item, &checkpoint)
+	if errFromItemUnmarshal != nil {
+		errorString := "ItemUnMarshalError" + ": " + source
+		logger().Error("ItemUnMarshalError", "operation", "LoadCheckpoint", "table", d.TableName, "source", source, "error", errFromItemUnmarshal.Error())
+		return checkpoint, false, errors.New(errorString)
+	}
+	return checkpoint, true, nil
+}
+
+//Save the checkpoint, replacing the previous one
+func (d *DynamoDBCheckpointStore) Save(ctx context.Context, checkpoint ImportCheckpoint) error {
+
+	d.initClient()
+
+	inputItemValue, errMarshalMap := dynamodbattribute.MarshalMap(checkpoint)
+	if errMarshalMap != nil {
+		errorString := "Marshal Map Error" + "[" + errMarshalMap.Error() + "]"
+		logger().Error("Marshal Map Error", "operation", "SaveCheckpoint", "table", d.TableName, "source", checkpoint.Source, "error", errMarshalMap.Error())
+		return errors.New(errorString)
+	}
+
+	_, errPutItem := d.Client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item:      inputItemValue,
+		TableName: aws.String(d.TableName),
+	})
+	if errPutItem != nil {
+		errorString := "Put Item Error" + "[" + errPutItem.Error() + "]"
+		logger().Error("Put Item Error", "operation", "SaveCheckpoint", "table", d.TableName, "source", checkpoint.Source, "error", errPutItem.Error())
+		return errors.New(errorString)
+	}
+	return nil
+}
+
+func (d *DynamoDBCheckpointStore) initClient() {
+	if d.Client != nil {
+		return
+	}
+	region := "us-east-2"
+	awsSession, _ := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
+	d.Client = dynamodb.New(awsSession)
+}
+
+//S3CheckpointStore keeps checkpoints as JSON objects at <Prefix><source>.checkpoint.json
+type S3CheckpointStore struct {
+	Bucket string
+	Prefix string
+
+	// Client, created from the default region when nil
+	Client s3iface.S3API
+}
+
+//Load the checkpoint of source
+func (c *S3CheckpointStore) Load(ctx context.Context, source string) (ImportCheckpoint, bool, error) {
+
+	var checkpoint ImportCheckpoint
+	c.initClient()
+
+	object, errGetObject := c.Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.Bucket),
+		Key:    aws.String(c.Prefix + source + ".checkpoint.json"),
+	})
+	if awsErr, ok := errGetObject.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		return checkpoint, false, nil
+	}
+	if errGetObject != nil {
+		errorString := "Error while Reading from S3 Bucket" + "[" + errGetObject.Error() + "]"
+		logger().Error("Error while Reading from S3 Bucket", "operation", "LoadCheckpoint", "bucket", c.Bucket, "source", source, "error", errGetObject.Error())
+		return checkpoint, false, errors.New(errorString)
+	}
+	defer object.Body.Close()
+
+	if errDecode := json.NewDecoder(object.Body).Decode(&checkpoint); errDecode != nil {
+		errorString := "CheckpointUnMarshalError" + ": " + source
+		logger().Error("CheckpointUnMarshalError", "operation", "LoadCheckpoint", "bucket", c.Bucket, "source", source, "error", errDecode.Error())
+		return checkpoint, false, errors.New(errorString)
+	}
+	return checkpoint, true, nil
+}
+
+//Save the checkpoint, replacing the previous one
+func (c *S3CheckpointStore) Save(ctx context.Context, checkpoint ImportCheckpoint) error {
+
+	c.initClient()
+
+	payload, errMarshal := json.Marshal(checkpoint)
+	if errMarshal != nil {
+		errorString := "Marshal Checkpoint Error" + "[" + errMarshal.Error() + "]"
+		logger().Error("Marshal Checkpoint Error", "operation", "SaveCheckpoint", "bucket", c.Bucket, "source", checkpoint.Source, "error", errMarshal.Error())
+		return errors.New(errorString)
+	}
+
+	s3BucketInput := &s3.PutObjectInput{
+		Body:        aws.ReadSeekCloser(bytes.NewReader(payload)),
+		Bucket:      aws.String(c.Bucket),
+		Key:         aws.String(c.Prefix + checkpoint.Source + ".checkpoint.json"),
+		ContentType: aws.String("application/json"),
+	}
+
+	_, err := c.Client.PutObjectWithContext(ctx, s3BucketInput)
+	if err != nil {
+		errorString := "Error while Uploading to S3 Bucket" + "[" + err.Error() + "]"
+		logger().Error("Error while Uploading to S3 Bucket", "operation", "SaveCheckpoint", "bucket", c.Bucket, "source", checkpoint.Source, "error", err.Error())
+		return errors.New(errorString)
+	}
+	return nil
+}
+
+func (c *S3CheckpointStore) initClient() {
+	if c.Client != nil {
+		return
+	}
+	region := "us-east-2"
+	awsSession, _ := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
+	c.Client = s3.New(awsSession)
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+//Supported formats of uploaded user files
+const (
+	FormatCSV       = "csv"
+	FormatJSONLines = "jsonl"
+	FormatJSONArray = "json"
+)
+
+//maxBatchWriteItems accepted by a single BatchWriteItem call
+const maxBatchWriteItems = 25
+
+//maxBatchWriteAttempts before unprocessed items are reported as rejected
+const maxBatchWriteAttempts = 6
+
+//IngestHandler bulk loads users from files uploaded to a bucket.
+//Wire it into a Lambda with lambda.Start(handler.Handle)
+type IngestHandler struct {
+
+	// Table the users are written to
+	TableName string
+
+	// Bucket receiving the per file reports, the source bucket when empty
+	ReportBucket string
+
+	// Key prefix of the reports, "reports/" when empty. Uploads below it are not ingested
+	ReportPrefix string
+
+	// Clients, created from the default region when nil
+	DynamoDB dynamodbiface.DynamoDBAPI
+	S3       s3iface.S3API
+}
+
+//IngestReport written back to S3 for every ingested file
+type IngestReport struct {
+	Bucket     string          `json:"bucket"`
+	Key        string          `json:"key"`
+	Format     string          `json:"format"`
+	Accepted   int             `json:"accepted"`
+	Rejected   int             `json:"rejected"`
+	Rows       []IngestRowInfo `json:"rows"`
+	StartedAt  string          `json:"startedAt"`
+	FinishedAt string          `json:"finishedAt"`
+}
+
+//IngestRowInfo outcome of a single row of the file
+type IngestRowInfo struct {
+
+	// Line of the row in CSV and JSON Lines files, position of the element in JSON arrays
+	Row int `json:"row"`
+
+	UserId string `json:"userId,omitempty"`
+
+	// "accepted" or "rejected"
+	Status string `json:"status"`
+
+	Reason string `json:"reason,omitempty"`
+}
+
+//Handle every ObjectCreated record of the event
+func (h *IngestHandler) Handle(ctx context.Context, event events.S3Event) error {
+	SetRequestContext(ctx)
+	defer FlushMetrics()
+	defer FlushTraces()
+
+	h.initClients()
+
+	for _, record := range event.Records {
+		if !strings.HasPrefix(record.EventName, "ObjectCreated") {
+			continue
+		}
+
+		key, errKey := url.QueryUnescape(record.S3.Object.Key)
+		if errKey != nil {
+			errorString := "InvalidObjectKey" + ": " + record.S3.Object.Key
+			logger().Error("InvalidObjectKey", "operation", "Ingest", "bucket", record.S3.Bucket.Name, "key", record.S3.Object.Key)
+			return errors.New(errorString)
+		}
+		if strings.HasPrefix(key, h.reportPrefix()) {
+			continue
+		}
+
+		if _, errIngest := h.IngestObject(ctx, record.S3.Bucket.Name, key); errIngest != nil {
+			return errIngest
+		}
+	}
+	return nil
+}
+
+//IngestObject streams the object into the table and uploads its report
+func (h *IngestHandler) IngestObject(ctx context.Context, bucketName, objectKey string) (IngestReport, error) {
+
+	start := time.Now()
+	opLogger := logger().With("operation", "Ingest", "table", h.TableName, "bucket", bucketName, "key", objectKey)
+
+	h.initClients()
+
+	report := IngestReport{
+		Bucket:    bucketName,
+		Key:       objectKey,
+		Rows:      []IngestRowInfo{},
+		StartedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	object, errGetObject := h.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(objectKey),
+	})
+	if errGetObject != nil {
+		errorString := "Error while Reading from S3 Bucket" + "[" + errGetObject.Error() + "]"
+		opLogger.Error("Error while Reading from S3 Bucket", "error", errGetObject.Error(), "durationMs", sinceMs(start))
+		return report, errors.New(errorString)
+	}
+	defer object.Body.Close()
+
+	var body io.Reader = object.Body
+	if strings.HasSuffix(objectKey, ".gz") {
+		gzipReader, errGzip := gzip.NewReader(object.Body)
+		if errGzip != nil {
+			errorString := "GzipError" + ": " + objectKey + "[" + errGzip.Error() + "]"
+			opLogger.Error("GzipError", "error", errGzip.Error(), "durationMs", sinceMs(start))
+			return report, errors.New(errorString)
+		}
+		defer gzipReader.Close()
+		body = gzipReader
+	}
+
+	report.Format = ingestFormat(objectKey, aws.StringValue(object.ContentType))
+
+	writer := &userBatchWriter{ctx: ctx, client: h.DynamoDB, tableName: h.TableName, report: &report}
+	errParse := parseUsers(body, report.Format, func(row int, user UserInfoAdvanced, errRow error) error {
+		if errRow == nil {
+			errRow = validateIngestedUser(user)
+		}
+		if errRow != nil {
+			report.reject(row, user.UserId, errRow.Error())
+			return nil
+		}
+		return writer.add(row, user)
+	})
+	if errParse == nil {
+		errParse = writer.flush()
+	}
+	if errParse != nil {
+		errorString := "IngestError" + ": " + objectKey + "[" + errParse.Error() + "]"
+		opLogger.Error("IngestError", "error", errParse.Error(), "durationMs", sinceMs(start))
+		return report, errors.New(errorString)
+	}
+
+	report.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+	if errReport := h.uploadReport(ctx, report); errReport != nil {
+		return report, errReport
+	}
+
+	opLogger.Info("Ingested Successfully", "format", report.Format, "accepted", report.Accepted, "rejected", report.Rejected, "durationMs", sinceMs(start))
+	return report, nil
+}
+
+func (h *IngestHandler) initClients() {
+	if h.DynamoDB != nil && h.S3 != nil {
+		return
+	}
+	region := "us-east-2"
+	awsSession, _ := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
+	if h.DynamoDB == nil {
+		h.DynamoDB = dynamodb.New(awsSession)
+	}
+	if h.S3 == nil {
+		h.S3 = s3.New(awsSession)
+	}
+}
+
+func (h *IngestHandler) reportPrefix() string {
+	if h.ReportPrefix == "" {
+		return "reports/"
+	}
+	return h.ReportPrefix
+}
+
+//uploadReport to <ReportPrefix><objectKey>.report.json
+func (h *IngestHandler) uploadReport(ctx context.Context, report IngestReport) error {
+
+	bucketName := h.ReportBucket
+	if bucketName == "" {
+		bucketName = report.Bucket
+	}
+	objectKey := h.reportPrefix() + report.Key + ".report.json"
+
+	payload, errMarshal := json.Marshal(report)
+	if errMarshal != nil {
+		errorString := "Marshal Report Error" + "[" + errMarshal.Error() + "]"
+		logger().Error("Marshal Report Error", "operation", "Ingest", "key", report.Key, "error", errMarshal.Error())
+		return errors.New(errorString)
+	}
+
+	s3BucketInput := &s3.PutObjectInput{
+		Body:        aws.ReadSeekCloser(bytes.NewReader(payload)),
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(objectKey),
+		ContentType: aws.String("application/json"),
+	}
+
+	_, err := h.S3.PutObjectWithContext(ctx, s3BucketInput)
+	if err != nil {
+		errorString := "Error while Uploading to S3 Bucket" + "[" + err.Error() + "]"
+		logger().Error("Error while Uploading to S3 Bucket", "operation", "Ingest", "bucket", bucketName, "key", objectKey, "error", err.Error())
+		return errors.New(errorString)
+	}
+	return nil
+}
+
+//rowRecorder collects the outcome of written rows
+type rowRecorder interface {
+	accept(row int, userID string)
+	reject(row int, userID, reason string)
+}
+
+func (r *IngestReport) accept(row int, userID string) {
+	r.Accepted++
+	r.Rows = append(r.Rows, IngestRowInfo{Row: row, UserId: userID, Status: "accepted"})
+}
+
+func (r *IngestReport) reject(row int, userID, reason string) {
+	r.Rejected++
+	r.Rows = append(r.Rows, IngestRowInfo{Row: row, UserId: userID, Status: "rejected", Reason: reason})
+}
+
+//ingestFormat from the object key extension, then the content type, defaulting to JSON Lines
+func ingestFormat(objectKey, contentType string) string {
+
+	switch strings.ToLower(path.Ext(strings.TrimSuffix(objectKey, ".gz"))) {
+	case ".csv":
+		return FormatCSV
+	case ".jsonl", ".ndjson":
+		return FormatJSONLines
+	case ".json":
+		return FormatJSONArray
+	}
+
+	switch {
+	case strings.Contains(contentType, "csv"):
+		return FormatCSV
+	case strings.Contains(contentType, "application/json"):
+		return FormatJSONArray
+	}
+	return FormatJSONLines
+}
+
+//parseUsers streams the rows of body, calling onRow for each. Row level decode errors are
+//passed to onRow, errors reading the stream itself are returned
+func parseUsers(body io.Reader, format string, onRow func(row int, user UserInfoAdvanced, errRow error) error) error {
+
+	switch format {
+	case FormatCSV:
+		return parseUsersCSV(body, onRow)
+	case FormatJSONArray:
+		return parseUsersJSONArray(body, onRow)
+	}
+	return parseUsersJSONLines(body, onRow)
+}
+
+func parseUsersCSV(body io.Reader, onRow func(int, UserInfoAdvanced, error) error) error {
+
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, errHeader := reader.Read()
+	if errHeader != nil {
+		return errors.New("CSVHeaderError" + "[" + errHeader.Error() + "]")
+	}
+
+	for line := 2; ; line++ {
+		record, errRead := reader.Read()
+		if errRead == io.EOF {
+			return nil
+		}
+		if parseErr, ok := errRead.(*csv.ParseError); ok {
+			if errRow := onRow(line, UserInfoAdvanced{}, parseErr); errRow != nil {
+				return errRow
+			}
+			continue
+		}
+		if errRead != nil {
+			return errRead
+		}
+
+		if errRow := onRow(line, csvUser(header, record), nil); errRow != nil {
+			return errRow
+		}
+	}
+}
+
+//csvUser maps a CSV record to the user using the json names in the header
+func csvUser(header, record []string) UserInfoAdvanced {
+	values := make(map[string]string, len(header))
+	for i, column := range header {
+		if i < len(record) {
+			values[strings.TrimSpace(column)] = strings.TrimSpace(record[i])
+		}
+	}
+	expiresAt, _ := strconv.ParseInt(values["expiresAt"], 10, 64)
+	return UserInfoAdvanced{
+		UserId:    values["userId"],
+		FirstName: values["firstName"],
+		LastName:  values["lastName"],
+		BatchID:   values["batchId"],
+		Group:     values["group"],
+		Active:    values["active"],
+		CreatedAt: values["createdAt"],
+		UpdatedAt: values["updatedAt"],
+		CreatedBy: values["createdBy"],
+		ExpiresAt: expiresAt,
+	}
+}
+
+func parseUsersJSONLines(body io.Reader, onRow func(int, UserInfoAdvanced, error) error) error {
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var user UserInfoAdvanced
+		errRow := json.Unmarshal(text, &user)
+		if errRow := onRow(line, user, errRow); errRow != nil {
+			return errRow
+		}
+	}
+	return scanner.Err()
+}
+
+func parseUsersJSONArray(body io.Reader, onRow func(int, UserInfoAdvanced, error) error) error {
+
+	decoder := json.NewDecoder(body)
+	if token, errToken := decoder.Token(); errToken != nil || token != json.Delim('[') {
+		return errors.New("JSONArrayExpected")
+	}
+
+	for row := 1; decoder.More(); row++ {
+		var raw json.RawMessage
+		if errDecode := decoder.Decode(&raw); errDecode != nil {
+			return errDecode
+		}
+		var user UserInfoAdvanced
+		errRow := json.Unmarshal(raw, &user)
+		if errRow := onRow(row, user, errRow); errRow != nil {
+			return errRow
+		}
+	}
+	return nil
+}
+
+//validateIngestedUser checks the user against the rules of UserInfoAdvanced
+func validateIngestedUser(user UserInfoAdvanced) error {
+	return Validate(user)
+}
+
+//userBatchWriter buffers users into BatchWriteItem calls of up to 25 items
+type userBatchWriter struct {
+	ctx       context.Context
+	client    dynamodbiface.DynamoDBAPI
+	tableName string
+	report    rowRecorder
+
+	rows    []int
+	users   []UserInfoAdvanced
+	pending map[string]bool
+}
+
+func (w *userBatchWriter) add(row int, user UserInfoAdvanced) error {
+
+	// A batch may not contain the same key twice
+	if w.pending[user.UserId] {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	if w.pending == nil {
+		w.pending = make(map[string]bool)
+	}
+
+	// Items are replaced, so the creation fields are kept only when the input carries them
+	user.UpdatedAt = auditTimestamp()
+	if user.CreatedAt == "" {
+		user.CreatedAt = user.UpdatedAt
+	}
+	if user.CreatedBy == "" {
+		user.CreatedBy = currentActor()
+	}
+
+	w.rows = append(w.rows, row)
+	w.users = append(w.users, user)
+	w.pending[user.UserId] = true
+
+	if len(w.users) == maxBatchWriteItems {
+		return w.flush()
+	}
+	return nil
+}
+
+//flush writes the buffered users, retrying unprocessed items with backoff
+func (w *userBatchWriter) flush() error {
+
+	if len(w.users) == 0 {
+		return nil
+	}
+	rows, users := w.rows, w.users
+	w.rows, w.users, w.pending = nil, nil, nil
+
+	requests := make([]*dynamodb.WriteRequest, 0, len(users))
+	marshalErrors := make(map[int]string)
+	for i, user := range users {
+		item, errMarshalMap := dynamodbattribute.MarshalMap(user)
+		if errMarshalMap != nil {
+			marshalErrors[i] = "Marshal Map Error" + "[" + errMarshalMap.Error() + "]"
+			continue
+		}
+		requests = append(requests, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: item}})
+	}
+
+	for attempt := 0; len(requests) > 0 && attempt < maxBatchWriteAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(50<<uint(attempt)) * time.Millisecond)
+		}
+
+		output, errBatchWrite := w.client.BatchWriteItemWithContext(w.ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]*dynamodb.WriteRequest{w.tableName: requests},
+		})
+		if errBatchWrite != nil {
+			errorString := "BatchWriteItemError" + "[" + errBatchWrite.Error() + "]"
+			logger().Error("BatchWriteItemError", "operation", "BatchWriteItem", "table", w.tableName, "items", len(requests), "error", errBatchWrite.Error())
+			return errors.New(errorString)
+		}
+		requests = output.UnprocessedItems[w.tableName]
+	}
+
+	unprocessed := make(map[string]bool, len(requests))
+	for _, request := range requests {
+		unprocessed[aws.StringValue(request.PutRequest.Item["userId"].S)] = true
+	}
+	for i, user := range users {
+		if reason, failed := marshalErrors[i]; failed {
+			w.report.reject(rows[i], user.UserId, reason)
+		} else if unprocessed[user.UserId] {
+			w.report.reject(rows[i], user.UserId, "UnprocessedItem")
+		} else {
+			w.report.accept(rows[i], user.UserId)
+		}
+	}
+	return nil
+}
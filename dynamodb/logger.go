@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+//LogLevelEnv sets the minimum level logged: debug, info (default), warn or error
+const LogLevelEnv = "LOG_LEVEL"
+
+var (
+	loggerMu   sync.RWMutex
+	baseLogger = NewLogger(os.Stdout)
+	requestID  string
+)
+
+//NewLogger writing JSON to w at the level set by LOG_LEVEL, tagged with the Lambda function name
+func NewLogger(w io.Writer) *slog.Logger {
+	handler := slog.NewJSONHandler(w, &slog.HandlerOptions{Level: logLevel()})
+	return slog.New(handler).With("function", lambdacontext.FunctionName)
+}
+
+//SetLogger replaces the logger, e.g. with NewLogger(&buffer) in tests
+func SetLogger(l *slog.Logger) {
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+	baseLogger = l
+}
+
+//SetRequestContext tags the following log entries with the request ID of the Lambda
+//invocation in ctx, continues its trace and bounds retries by its deadline. Handlers call
+//it first, Lambda serves one invocation at a time
+func SetRequestContext(ctx context.Context) {
+	setTraceParent(ctx)
+	setRetryDeadline(ctx)
+
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+	requestID = ""
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		requestID = lc.AwsRequestID
+	}
+}
+
+//logger for the current invocation
+func logger() *slog.Logger {
+	loggerMu.RLock()
+	defer loggerMu.RUnlock()
+	if requestID == "" {
+		return baseLogger
+	}
+	return baseLogger.With("requestId", requestID)
+}
+
+//currentRequestID of the invocation set by SetRequestContext
+func currentRequestID() string {
+	loggerMu.RLock()
+	defer loggerMu.RUnlock()
+	return requestID
+}
+
+//sinceMs for the "durationMs" field
+func sinceMs(start time.Time) int64 {
+	return time.Since(start).Milliseconds()
+}
+
+func logLevel() slog.Level {
+	switch strings.ToLower(os.Getenv(LogLevelEnv)) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
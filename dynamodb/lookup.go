@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+)
+
+//FirstNameIndexEnv names a GSI keyed by "firstName" with "group" as sort key, used by
+//GetListedUberStores instead of filtering the group when set
+const FirstNameIndexEnv = "FIRST_NAME_INDEX"
+
+//Limits of multi value lookups
+const (
+
+	// Operands of a single IN condition
+	maxInOperands = 100
+
+	// Values of a single lookup
+	maxLookupValues = 1000
+
+	// Queries of a lookup running at the same time
+	lookupConcurrency = 8
+
+	// Length of an expression string
+	maxExpressionLength = 4096
+)
+
+var (
+	firstNameIndexMu sync.RWMutex
+	firstNameIndex   = os.Getenv(FirstNameIndexEnv)
+)
+
+//SetFirstNameIndex used by GetListedUberStores, empty to filter the group query
+func SetFirstNameIndex(indexName string) {
+	firstNameIndexMu.Lock()
+	defer firstNameIndexMu.Unlock()
+	firstNameIndex = indexName
+}
+
+func currentFirstNameIndex() string {
+	firstNameIndexMu.RLock()
+	defer firstNameIndexMu.RUnlock()
+	return firstNameIndex
+}
+
+//inFilters of name IN values, one condition per chunk of maxInOperands values
+func inFilters(name string, values []string) []expression.ConditionBuilder {
+	var filters []expression.ConditionBuilder
+	for len(values) > 0 {
+		chunk := values
+		if len(chunk) > maxInOperands {
+			chunk = chunk[:maxInOperands]
+		}
+		values = values[len(chunk):]
+
+		operands := make([]expression.OperandBuilder, 0, len(chunk)-1)
+		for _, value := range chunk[1:] {
+			operands = append(operands, expression.Value(value))
+		}
+		filters = append(filters, expression.Name(name).In(expression.Value(chunk[0]), operands...))
+	}
+	return filters
+}
+
+//uniqueValues in their first order
+func uniqueValues(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := make([]string, 0, len(values))
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+//lookupUsers runs the queries concurrently, reading every page, and returns the users
+//de-duplicated and sorted by userId. The first failed query fails the lookup and cancels the others
+func lookupUsers(client dynamodbiface.DynamoDBAPI, operation, tableName string, queries []*dynamodb.QueryInput) ([]UserInfoAdvanced, error) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		errFirst error
+		found    = map[string]UserInfoAdvanced{}
+	)
+	slots := make(chan struct{}, lookupConcurrency)
+
+	for _, queryInput := range queries {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(queryInput *dynamodb.QueryInput) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			start := time.Now()
+			var errUnMarshal error
+			if ctx.Err() != nil {
+				return
+			}
+			errQueryDynamoDB := client.QueryPagesWithContext(ctx, queryInput, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+				recordCapacity(operation, tableName, page.ConsumedCapacity)
+				var pageUsers []UserInfoAdvanced
+				if errUnMarshal = dynamodbattribute.UnmarshalListOfMaps(page.Items, &pageUsers); errUnMarshal != nil {
+					return false
+				}
+				mu.Lock()
+				for _, user := range pageUsers {
+					found[user.UserId] = user
+				}
+				mu.Unlock()
+				return true
+			})
+			recordCall(operation, tableName, start, errQueryDynamoDB)
+			if errQueryDynamoDB == nil {
+				errQueryDynamoDB = errUnMarshal
+			}
+			if errQueryDynamoDB != nil {
+				mu.Lock()
+				if errFirst == nil {
+					errFirst = errQueryDynamoDB
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}(queryInput)
+	}
+	wg.Wait()
+
+	users := make([]UserInfoAdvanced, 0, len(found))
+	if errFirst != nil {
+		return users, errFirst
+	}
+	for _, user := range found {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].UserId < users[j].UserId })
+	return users, nil
+}
+
+//storeQueries of GetListedUberStores: one query of the first name index per value when set,
+//otherwise one group query per chunk of values filtered with IN
+func storeQueries(tableName string, storeIDs []string, group, active string) ([]*dynamodb.QueryInput, error) {
+
+	proj := advancedProjection()
+
+	var queries []*dynamodb.QueryInput
+	if indexName := currentFirstNameIndex(); indexName != "" {
+		filter := readable()
+		if active != AnyUsers {
+			if active == "" {
+				active = ActiveUsers
+			}
+			filter = expression.Name("active").Equal(expression.Value(active)).And(filter)
+		}
+		for _, storeID := range storeIDs {
+			expr, errExpression := expression.NewBuilder().
+				WithKeyCondition(expression.Key("firstName").Equal(expression.Value(storeID)).
+					And(expression.Key("group").Equal(expression.Value(group)))).
+				WithFilter(filter).
+				WithProjection(proj).
+				Build()
+			if errExpression != nil {
+				return nil, errExpression
+			}
+			queries = append(queries, storeQuery(tableName, indexName, expr))
+		}
+		return queries, nil
+	}
+
+	// The IN chunks are ORed into one filter, so the group partition is read once. A filter
+	// over the expression size limit is split, each further query reading the partition again
+	build := func(filter expression.ConditionBuilder) (expression.Expression, error) {
+		return expression.NewBuilder().
+			WithKeyCondition(groupKeyCondition(group, active)).
+			WithFilter(filter.And(readable())).
+			WithProjection(proj).
+			Build()
+	}
+	var current expression.ConditionBuilder
+	var built expression.Expression
+	chunks := 0
+	for _, filter := range inFilters("firstName", storeIDs) {
+		candidate := filter
+		if chunks > 0 {
+			candidate = current.Or(filter)
+		}
+		expr, errExpression := build(candidate)
+		if errExpression != nil {
+			return nil, errExpression
+		}
+		if chunks > 0 && len(aws.StringValue(expr.Filter())) > maxExpressionLength {
+			queries = append(queries, storeQuery(tableName, "groupIndex", built))
+			candidate, chunks = filter, 0
+			if expr, errExpression = build(candidate); errExpression != nil {
+				return nil, errExpression
+			}
+		}
+		current, built = candidate, expr
+		chunks++
+	}
+	if chunks > 0 {
+		queries = append(queries, storeQuery(tableName, "groupIndex", built))
+	}
+	return queries, nil
+}
+
+func storeQuery(tableName, indexName string, expr expression.Expression) *dynamodb.QueryInput {
+	return &dynamodb.QueryInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		TableName:                 aws.String(tableName),
+		IndexName:                 aws.String(indexName),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+		ReturnConsumedCapacity:    aws.String(dynamodb.ReturnConsumedCapacityTotal),
+	}
+}
+
+//pageUsers after the cursor, a userId, bounded by page.Limit
+func pageUsers(users []UserInfoAdvanced, page Page) (UserPage, error) {
+	result := UserPage{Users: users}
+	after, errCursor := decodeStringCursor(page.Cursor)
+	if errCursor != nil {
+		return result, errCursor
+	}
+	first := sort.Search(len(users), func(i int) bool { return users[i].UserId > after })
+	result.Users = users[first:]
+	if page.Limit > 0 && int64(len(result.Users)) > page.Limit {
+		result.Users = result.Users[:page.Limit]
+		result.NextCursor = encodeStringCursor(result.Users[len(result.Users)-1].UserId)
+	}
+	return result, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+//fakeQueryTable returns its items to every query, applying only the projection
+type fakeQueryTable struct {
+	dynamodbiface.DynamoDBAPI
+	items []map[string]*dynamodb.AttributeValue
+}
+
+func (f *fakeQueryTable) QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, options ...request.Option) error {
+	output := &dynamodb.QueryOutput{}
+	for _, item := range f.items {
+		projected := map[string]*dynamodb.AttributeValue{}
+		for _, placeholder := range strings.Split(aws.StringValue(input.ProjectionExpression), ", ") {
+			name := aws.StringValue(input.ExpressionAttributeNames[placeholder])
+			if value, ok := item[name]; ok {
+				projected[name] = value
+			}
+		}
+		output.Items = append(output.Items, projected)
+	}
+	fn(output, true)
+	return nil
+}
+
+func TestStoreLookupReadsExpiryAndDeletion(t *testing.T) {
+	stored := UserInfoAdvanced{UserId: "user-1", FirstName: "store", Group: "group-1", Active: ActiveUsers,
+		DeletedAt: "2026-01-02T03:04:05Z", ExpiresAt: TTLAfter(time.Hour)}
+	item, err := dynamodbattribute.MarshalMap(stored)
+	if err != nil {
+		t.Fatalf("MarshalMap: %v", err)
+	}
+
+	queries, err := storeQueries("users", []string{"store"}, "group-1", ActiveUsers)
+	if err != nil {
+		t.Fatalf("storeQueries: %v", err)
+	}
+	users, err := lookupUsers(&fakeQueryTable{items: []map[string]*dynamodb.AttributeValue{item}}, "GetListedUberStores", "users", queries)
+	if err != nil {
+		t.Fatalf("lookupUsers: %v", err)
+	}
+	if len(users) != 1 {
+		t.Fatalf("users = %d, want 1", len(users))
+	}
+	if users[0].ExpiresAt != stored.ExpiresAt {
+		t.Errorf("ExpiresAt = %d, want %d", users[0].ExpiresAt, stored.ExpiresAt)
+	}
+	if users[0].DeletedAt != stored.DeletedAt {
+		t.Errorf("DeletedAt = %q, want %q", users[0].DeletedAt, stored.DeletedAt)
+	}
+}
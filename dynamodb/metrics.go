@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+//MetricsNamespaceEnv sets the CloudWatch namespace of the emitted metrics
+const MetricsNamespaceEnv = "METRICS_NAMESPACE"
+
+//Metric units
+const (
+	UnitMilliseconds = "Milliseconds"
+	UnitCount        = "Count"
+	UnitBytes        = "Bytes"
+)
+
+//maxEMFValues per metric in one EMF document
+const maxEMFValues = 100
+
+//MetricsSink collects metrics during an invocation
+type MetricsSink interface {
+	PutMetric(name string, value float64, unit string, dimensions map[string]string)
+
+	// Flush sends the collected metrics, called at the end of every invocation
+	Flush() error
+}
+
+var (
+	metricsMu   sync.RWMutex
+	metricsSink MetricsSink = NewEMFSink(os.Stdout)
+)
+
+//SetMetricsSink replaces the sink, e.g. with a MemorySink in tests
+func SetMetricsSink(sink MetricsSink) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metricsSink = sink
+}
+
+//FlushMetrics collected during the invocation, handlers defer it
+func FlushMetrics() error {
+	metricsMu.RLock()
+	defer metricsMu.RUnlock()
+	return metricsSink.Flush()
+}
+
+func putMetric(name string, value float64, unit string, dimensions map[string]string) {
+	metricsMu.RLock()
+	defer metricsMu.RUnlock()
+	metricsSink.PutMetric(name, value, unit, dimensions)
+}
+
+//EMFSink writes CloudWatch Embedded Metric Format documents, one per dimension set,
+//which CloudWatch Logs turns into metrics
+type EMFSink struct {
+	Namespace string
+	Writer    io.Writer
+
+	mu     sync.Mutex
+	groups map[string]*emfGroup
+}
+
+type emfGroup struct {
+	dimensions map[string]string
+	units      map[string]string
+	values     map[string][]float64
+}
+
+//NewEMFSink writing to w in the namespace set by METRICS_NAMESPACE
+func NewEMFSink(w io.Writer) *EMFSink {
+	namespace := os.Getenv(MetricsNamespaceEnv)
+	if namespace == "" {
+		namespace = "AWSLambdaGoLang"
+	}
+	return &EMFSink{Namespace: namespace, Writer: w}
+}
+
+//PutMetric adds a value to the metric of the dimension set
+func (s *EMFSink) PutMetric(name string, value float64, unit string, dimensions map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.groups == nil {
+		s.groups = make(map[string]*emfGroup)
+	}
+	key := dimensionsKey(dimensions)
+	group, ok := s.groups[key]
+	if !ok {
+		group = &emfGroup{dimensions: dimensions, units: make(map[string]string), values: make(map[string][]float64)}
+		s.groups[key] = group
+	}
+	group.units[name] = unit
+	group.values[name] = append(group.values[name], value)
+}
+
+//Flush writes the collected metrics and resets the sink
+func (s *EMFSink) Flush() error {
+	s.mu.Lock()
+	groups := s.groups
+	s.groups = nil
+	s.mu.Unlock()
+
+	encoder := json.NewEncoder(s.Writer)
+	timestamp := time.Now().UnixNano() / int64(time.Millisecond)
+
+	for _, group := range groups {
+		dimensionNames := make([]string, 0, len(group.dimensions))
+		for name := range group.dimensions {
+			dimensionNames = append(dimensionNames, name)
+		}
+		sort.Strings(dimensionNames)
+
+		// Each metric holds at most 100 values per document
+		for offset := 0; ; offset += maxEMFValues {
+			document := make(map[string]interface{})
+			definitions := []map[string]string{}
+			for name, values := range group.values {
+				if offset >= len(values) {
+					continue
+				}
+				end := offset + maxEMFValues
+				if end > len(values) {
+					end = len(values)
+				}
+				if end-offset == 1 {
+					document[name] = values[offset]
+				} else {
+					document[name] = values[offset:end]
+				}
+				definitions = append(definitions, map[string]string{"Name": name, "Unit": group.units[name]})
+			}
+			if len(definitions) == 0 {
+				break
+			}
+
+			for name, value := range group.dimensions {
+				document[name] = value
+			}
+			document["_aws"] = map[string]interface{}{
+				"Timestamp": timestamp,
+				"CloudWatchMetrics": []map[string]interface{}{{
+					"Namespace":  s.Namespace,
+					"Dimensions": [][]string{dimensionNames},
+					"Metrics":    definitions,
+				}},
+			}
+			if err := encoder.Encode(document); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//MetricDatum recorded by a MemorySink
+type MetricDatum struct {
+	Name       string
+	Value      float64
+	Unit       string
+	Dimensions map[string]string
+}
+
+//MemorySink records metrics, for tests
+type MemorySink struct {
+	mu    sync.Mutex
+	datum []MetricDatum
+}
+
+//PutMetric records the value
+func (m *MemorySink) PutMetric(name string, value float64, unit string, dimensions map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.datum = append(m.datum, MetricDatum{Name: name, Value: value, Unit: unit, Dimensions: dimensions})
+}
+
+//Flush keeps the recorded metrics
+func (m *MemorySink) Flush() error {
+	return nil
+}
+
+//Metrics recorded so far
+func (m *MemorySink) Metrics() []MetricDatum {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]MetricDatum{}, m.datum...)
+}
+
+func dimensionsKey(dimensions map[string]string) string {
+	pairs := make([]string, 0, len(dimensions))
+	for name, value := range dimensions {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+//errorType of an AWS error for the "Errors" metric, its error code when available
+func errorType(err error) string {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code()
+	}
+	return "Unknown"
+}
+
+//isThrottle reports errors caused by exceeding request rate or throughput limits
+func isThrottle(err error) bool {
+	switch errorType(err) {
+	case "ProvisionedThroughputExceededException", "ThrottlingException", "Throttling",
+		"RequestLimitExceeded", "TooManyRequestsException", "SlowDown":
+		return true
+	}
+	return false
+}
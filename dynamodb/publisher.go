@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/eventbridge/eventbridgeiface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+)
+
+//Domain event types published after a successful mutation
+const (
+	UserCreated  = "UserCreated"
+	UserUpdated  = "UserUpdated"
+	UserDeleted  = "UserDeleted"
+	UserRestored = "UserRestored"
+)
+
+//UserEventSchemaVersion of the UserEvent JSON, bumped on incompatible changes
+const UserEventSchemaVersion = "1.0"
+
+//Limits of a single PutEvents or PublishBatch call
+const (
+	maxEventsPerBatch = 10
+	maxBatchBytes     = 256 * 1024
+	maxPublishRetries = 3
+)
+
+//UserEvent published for every user mutation
+type UserEvent struct {
+	SchemaVersion string    `json:"schemaVersion"`
+	EventID       string    `json:"eventId"`
+	Type          string    `json:"type"`
+	OccurredAt    string    `json:"occurredAt"`
+	UserID        string    `json:"userId"`
+	User          *UserInfo `json:"user,omitempty"`
+}
+
+//EventPublisher delivers domain events
+type EventPublisher interface {
+	Publish(ctx context.Context, userEvents ...UserEvent) error
+}
+
+//userEventPublisher used by CreateNewUser, UpdateUserInfo and DeleteUser, nil disables publishing
+var userEventPublisher EventPublisher
+
+//SetEventPublisher used after successful mutations, nil disables publishing
+func SetEventPublisher(publisher EventPublisher) {
+	userEventPublisher = publisher
+}
+
+//NewUserEvent of the given type for user
+func NewUserEvent(eventType string, userID string, user *UserInfo) UserEvent {
+	return UserEvent{
+		SchemaVersion: UserEventSchemaVersion,
+		EventID:       newEventID(),
+		Type:          eventType,
+		OccurredAt:    time.Now().UTC().Format(time.RFC3339Nano),
+		UserID:        userID,
+		User:          user,
+	}
+}
+
+//publishUserEvent after a mutation. The mutation has already succeeded, so a failure is logged
+//rather than returned
+func publishUserEvent(eventType string, userID string, user *UserInfo) {
+	if userEventPublisher == nil {
+		return
+	}
+	if errPublish := userEventPublisher.Publish(context.Background(), NewUserEvent(eventType, userID, user)); errPublish != nil {
+		logger().Error("PublishEventError", "operation", "PublishEvent", "eventType", eventType, "userId", userID, "error", errPublish.Error())
+	}
+}
+
+//newEventID as a random UUID
+func newEventID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	encoded := hex.EncodeToString(id)
+	return encoded[0:8] + "-" + encoded[8:12] + "-" + encoded[12:16] + "-" + encoded[16:20] + "-" + encoded[20:]
+}
+
+//batchEvents splits the encoded events into batches within the per call limits
+func batchEvents(userEvents []UserEvent) ([][]UserEvent, [][]string, error) {
+
+	var batches [][]UserEvent
+	var details [][]string
+	batchBytes := 0
+
+	for _, userEvent := range userEvents {
+		detail, errMarshal := json.Marshal(userEvent)
+		if errMarshal != nil {
+			return nil, nil, errors.New("Marshal Event Error" + "[" + errMarshal.Error() + "]")
+		}
+
+		last := len(batches) - 1
+		if last < 0 || len(batches[last]) == maxEventsPerBatch || batchBytes+len(detail) > maxBatchBytes {
+			batches = append(batches, nil)
+			details = append(details, nil)
+			batchBytes = 0
+			last++
+		}
+		batches[last] = append(batches[last], userEvent)
+		details[last] = append(details[last], string(detail))
+		batchBytes += len(detail)
+	}
+	return batches, details, nil
+}
+
+//publisherSession of the clients created by the publishers
+func publisherSession() *session.Session {
+	region := "us-east-2"
+	awsSession, _ := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
+	return awsSession
+}
+
+//waitRetry before the retry of failed entries, returning early with the error of ctx when it
+//is done, e.g. at the Lambda deadline
+func waitRetry(ctx context.Context, attempt int) error {
+	if attempt == 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(100<<uint(attempt)) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return errors.New("PublishCanceled" + "[" + ctx.Err().Error() + "]")
+	}
+}
+
+//EventBridgePublisher puts events on an EventBridge bus with the event type as detail type
+type EventBridgePublisher struct {
+
+	// Bus name or ARN, the default bus when empty
+	EventBusName string
+
+	// Source of the events, "users.repository" when empty
+	Source string
+
+	// Client, created from the default region when nil
+	Client eventbridgeiface.EventBridgeAPI
+
+	clientOnce sync.Once
+}
+
+//Publish the events in batches of up to 10, retrying failed entries
+func (p *EventBridgePublisher) Publish(ctx context.Context, userEvents ...UserEvent) error {
+
+	p.clientOnce.Do(func() {
+		if p.Client == nil {
+			p.Client = eventbridge.New(publisherSession())
+		}
+	})
+	source := p.Source
+	if source == "" {
+		source = "users.repository"
+	}
+
+	batches, details, errBatch := batchEvents(userEvents)
+	if errBatch != nil {
+		return errBatch
+	}
+
+	for b, batch := range details {
+		entries := make([]*eventbridge.PutEventsRequestEntry, 0, len(batch))
+		for i := range batch {
+			entry := &eventbridge.PutEventsRequestEntry{
+				Source:     aws.String(source),
+				DetailType: aws.String(batches[b][i].Type),
+				Detail:     aws.String(batch[i]),
+			}
+			if p.EventBusName != "" {
+				entry.EventBusName = aws.String(p.EventBusName)
+			}
+			entries = append(entries, entry)
+		}
+
+		for attempt := 0; len(entries) > 0; attempt++ {
+			if attempt == maxPublishRetries {
+				return errors.New("PutEventsError" + "[" + strconv.Itoa(len(entries)) + " entries failed]")
+			}
+			if errWait := waitRetry(ctx, attempt); errWait != nil {
+				return errWait
+			}
+
+			output, errPut := p.Client.PutEventsWithContext(ctx, &eventbridge.PutEventsInput{Entries: entries})
+			if errPut != nil {
+				return errors.New("PutEventsError" + "[" + errPut.Error() + "]")
+			}
+
+			// Result entries are in request order, failed ones carry an error code
+			var failed []*eventbridge.PutEventsRequestEntry
+			for i, result := range output.Entries {
+				if result.ErrorCode != nil {
+					failed = append(failed, entries[i])
+				}
+			}
+			entries = failed
+		}
+	}
+	return nil
+}
+
+//SNSPublisher publishes events to a topic with the event type as the "type" message attribute
+type SNSPublisher struct {
+	TopicArn string
+
+	// Client, created from the default region when nil
+	Client snsiface.SNSAPI
+
+	clientOnce sync.Once
+}
+
+//Publish the events in batches of up to 10, retrying failed entries
+func (p *SNSPublisher) Publish(ctx context.Context, userEvents ...UserEvent) error {
+
+	p.clientOnce.Do(func() {
+		if p.Client == nil {
+			p.Client = sns.New(publisherSession())
+		}
+	})
+
+	batches, details, errBatch := batchEvents(userEvents)
+	if errBatch != nil {
+		return errBatch
+	}
+
+	for b, batch := range details {
+		entries := make([]*sns.PublishBatchRequestEntry, 0, len(batch))
+		for i := range batch {
+			entries = append(entries, &sns.PublishBatchRequestEntry{
+				Id:      aws.String(strconv.Itoa(i)),
+				Message: aws.String(batch[i]),
+				MessageAttributes: map[string]*sns.MessageAttributeValue{
+					"type": {DataType: aws.String("String"), StringValue: aws.String(batches[b][i].Type)},
+				},
+			})
+		}
+
+		for attempt := 0; len(entries) > 0; attempt++ {
+			if attempt == maxPublishRetries {
+				return errors.New("PublishBatchError" + "[" + strconv.Itoa(len(entries)) + " entries failed]")
+			}
+			if errWait := waitRetry(ctx, attempt); errWait != nil {
+				return errWait
+			}
+
+			output, errPublish := p.Client.PublishBatchWithContext(ctx, &sns.PublishBatchInput{
+				TopicArn:                   aws.String(p.TopicArn),
+				PublishBatchRequestEntries: entries,
+			})
+			if errPublish != nil {
+				return errors.New("PublishBatchError" + "[" + errPublish.Error() + "]")
+			}
+
+			failedIDs := make(map[string]bool, len(output.Failed))
+			for _, failure := range output.Failed {
+				failedIDs[aws.StringValue(failure.Id)] = true
+			}
+			var failed []*sns.PublishBatchRequestEntry
+			for _, entry := range entries {
+				if failedIDs[aws.StringValue(entry.Id)] {
+					failed = append(failed, entry)
+				}
+			}
+			entries = failed
+		}
+	}
+	return nil
+}
+
+//MemoryPublisher records published events, for tests
+type MemoryPublisher struct {
+	mu     sync.Mutex
+	events []UserEvent
+}
+
+//Publish records the events
+func (p *MemoryPublisher) Publish(ctx context.Context, userEvents ...UserEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, userEvents...)
+	return nil
+}
+
+//Events recorded so far
+func (p *MemoryPublisher) Events() []UserEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]UserEvent{}, p.events...)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/eventbridge/eventbridgeiface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+)
+
+func testEvents(count int) []UserEvent {
+	userEvents := make([]UserEvent, count)
+	for i := range userEvents {
+		userEvents[i] = NewUserEvent(UserCreated, "user-"+strconv.Itoa(i), &UserInfo{UserId: "user-" + strconv.Itoa(i)})
+	}
+	return userEvents
+}
+
+func TestBatchEventsLimits(t *testing.T) {
+	batches, details, err := batchEvents(testEvents(25))
+	if err != nil {
+		t.Fatalf("batchEvents: %v", err)
+	}
+	if len(batches) != 3 || len(batches[0]) != 10 || len(batches[1]) != 10 || len(batches[2]) != 5 {
+		t.Fatalf("batch sizes %d, want 10, 10 and 5", len(batches))
+	}
+	if len(details[2]) != 5 {
+		t.Errorf("details of the last batch = %d, want 5", len(details[2]))
+	}
+
+	// Three events of 100KB do not fit the 256KB of one call
+	large := testEvents(3)
+	for i := range large {
+		large[i].User.FirstName = strings.Repeat("a", 100*1024)
+	}
+	batches, _, err = batchEvents(large)
+	if err != nil || len(batches) != 2 {
+		t.Errorf("batches of large events = %d, err = %v, want 2", len(batches), err)
+	}
+}
+
+//fakeEventBridge fails the entries at failIndex of the first call
+type fakeEventBridge struct {
+	eventbridgeiface.EventBridgeAPI
+	failIndex map[int]bool
+	calls     [][]*eventbridge.PutEventsRequestEntry
+}
+
+func (f *fakeEventBridge) PutEventsWithContext(ctx aws.Context, input *eventbridge.PutEventsInput, options ...request.Option) (*eventbridge.PutEventsOutput, error) {
+	f.calls = append(f.calls, input.Entries)
+	output := &eventbridge.PutEventsOutput{}
+	for i := range input.Entries {
+		result := &eventbridge.PutEventsResultEntry{EventId: aws.String(strconv.Itoa(i))}
+		if len(f.calls) == 1 && f.failIndex[i] {
+			result = &eventbridge.PutEventsResultEntry{ErrorCode: aws.String("ThrottlingException")}
+		}
+		output.Entries = append(output.Entries, result)
+	}
+	return output, nil
+}
+
+func TestEventBridgePublisherRetriesFailedEntries(t *testing.T) {
+	client := &fakeEventBridge{failIndex: map[int]bool{1: true, 3: true}}
+	publisher := &EventBridgePublisher{EventBusName: "users", Client: client}
+
+	if err := publisher.Publish(context.Background(), testEvents(4)...); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if len(client.calls) != 2 || len(client.calls[0]) != 4 || len(client.calls[1]) != 2 {
+		t.Fatalf("calls = %d, want 4 entries then the 2 failed ones", len(client.calls))
+	}
+
+	var retried UserEvent
+	if err := json.Unmarshal([]byte(aws.StringValue(client.calls[1][0].Detail)), &retried); err != nil || retried.UserID != "user-1" {
+		t.Errorf("first retried entry = %+v, err = %v, want user-1", retried, err)
+	}
+	if aws.StringValue(client.calls[0][0].DetailType) != UserCreated || aws.StringValue(client.calls[0][0].EventBusName) != "users" {
+		t.Errorf("entry = %v", client.calls[0][0])
+	}
+}
+
+//fakeSNS fails the entries at failIndex of every call
+type fakeSNS struct {
+	snsiface.SNSAPI
+	failIndex map[int]bool
+	calls     int
+}
+
+func (f *fakeSNS) PublishBatchWithContext(ctx aws.Context, input *sns.PublishBatchInput, options ...request.Option) (*sns.PublishBatchOutput, error) {
+	f.calls++
+	output := &sns.PublishBatchOutput{}
+	for _, entry := range input.PublishBatchRequestEntries {
+		index, _ := strconv.Atoi(aws.StringValue(entry.Id))
+		if f.failIndex[index] {
+			output.Failed = append(output.Failed, &sns.BatchResultErrorEntry{Id: entry.Id, Code: aws.String("InternalError")})
+		}
+	}
+	return output, nil
+}
+
+func TestSNSPublisherGivesUpOnFailedEntries(t *testing.T) {
+	client := &fakeSNS{failIndex: map[int]bool{0: true}}
+	publisher := &SNSPublisher{TopicArn: "arn:aws:sns:us-east-2:123456789012:users", Client: client}
+
+	err := publisher.Publish(context.Background(), testEvents(2)...)
+	if err == nil || !strings.Contains(err.Error(), "1 entries failed") {
+		t.Fatalf("err = %v, want the failed entry reported", err)
+	}
+	if client.calls != maxPublishRetries {
+		t.Errorf("calls = %d, want %d", client.calls, maxPublishRetries)
+	}
+}
+
+func TestMemoryPublisherRecordsEvents(t *testing.T) {
+	publisher := &MemoryPublisher{}
+	SetEventPublisher(publisher)
+	defer SetEventPublisher(nil)
+
+	publishUserEvent(UserDeleted, "user-1", nil)
+	publishUserEvent(UserRestored, "user-1", nil)
+
+	userEvents := publisher.Events()
+	if len(userEvents) != 2 || userEvents[0].Type != UserDeleted || userEvents[1].Type != UserRestored {
+		t.Fatalf("events = %+v", userEvents)
+	}
+	if userEvents[0].SchemaVersion != UserEventSchemaVersion || userEvents[0].EventID == "" || userEvents[0].EventID == userEvents[1].EventID {
+		t.Errorf("event = %+v, want a schema version and distinct event IDs", userEvents[0])
+	}
+}
+
+func TestPublishStopsRetryingWhenCanceled(t *testing.T) {
+	client := &fakeEventBridge{failIndex: map[int]bool{0: true}}
+	publisher := &EventBridgePublisher{Client: client}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := publisher.Publish(ctx, testEvents(1)...)
+	if err == nil || !strings.Contains(err.Error(), "PublishCanceled") {
+		t.Fatalf("err = %v, want PublishCanceled", err)
+	}
+	if len(client.calls) != 1 {
+		t.Errorf("calls = %d, want no retry after the cancel", len(client.calls))
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+//User mutation operations accepted on the write queue
+const (
+	OperationCreate = "create"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+)
+
+//UserCommand is the JSON body of a write queue message
+type UserCommand struct {
+
+	// Deduplicates retried or re-sent commands, the SQS message ID when empty
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	// create, update or delete
+	Operation string `json:"operation"`
+
+	// User to write, only UserId is needed for delete. For create it is derived from the
+	// idempotency key when empty, so a redelivered command creates the same user
+	User UserInfo `json:"user"`
+}
+
+//UserCommandHandler applies user mutation commands from SQS through CreateNewUser,
+//UpdateUserInfo and DeleteUser. The event source mapping must enable
+//ReportBatchItemFailures. Wire it into a Lambda with lambda.Start(handler.Handle)
+type UserCommandHandler struct {
+
+	// Table the commands are applied to
+	TableName string
+
+	// Table with the "idempotencyKey" string partition key and TTL on "expiresAt"
+	// recording applied commands. Commands are not deduplicated when empty
+	IdempotencyTableName string
+
+	// How long applied commands are remembered, 24h when zero
+	IdempotencyTTL time.Duration
+
+	// Client for the idempotency table, created from the default region when nil
+	DynamoDB dynamodbiface.DynamoDBAPI
+}
+
+//Handle a batch of commands, returning the messages that must be retried.
+//In FIFO queues the messages following a failure in the same group are not applied
+func (h *UserCommandHandler) Handle(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
+	SetRequestContext(ctx)
+	defer FlushMetrics()
+	defer FlushTraces()
+
+	response := events.SQSEventResponse{BatchItemFailures: []events.SQSBatchItemFailure{}}
+	failedGroups := make(map[string]bool)
+
+	for _, message := range event.Records {
+		groupID := message.Attributes["MessageGroupId"]
+		if groupID != "" && failedGroups[groupID] {
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: message.MessageId})
+			continue
+		}
+
+		if errApply := h.handleMessage(ctx, message); errApply != nil {
+			logger().Error("UserCommandError", "operation", "ApplyUserCommand", "table", h.TableName, "messageId", message.MessageId, "error", errApply.Error())
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: message.MessageId})
+			if groupID != "" {
+				failedGroups[groupID] = true
+			}
+		}
+	}
+
+	logger().Info("Successfully Applied user commands", "operation", "ApplyUserCommand", "table", h.TableName, "applied", len(event.Records)-len(response.BatchItemFailures), "received", len(event.Records))
+	return response, nil
+}
+
+func (h *UserCommandHandler) handleMessage(ctx context.Context, message events.SQSMessage) error {
+
+	var command UserCommand
+	if errUnmarshal := json.Unmarshal([]byte(message.Body), &command); errUnmarshal != nil {
+		return errors.New("CommandUnMarshalError" + "[" + errUnmarshal.Error() + "]")
+	}
+	if command.IdempotencyKey == "" {
+		command.IdempotencyKey = message.MessageId
+	}
+	if command.Operation == OperationCreate && command.User.UserId == "" {
+		command.User.UserId = userIDForKey(command.IdempotencyKey)
+	}
+
+	applied, errLookup := h.alreadyApplied(ctx, command.IdempotencyKey)
+	if errLookup != nil {
+		return errLookup
+	}
+	if applied {
+		logger().Info("User command already applied", "operation", "ApplyUserCommand", "table", h.TableName, "idempotencyKey", command.IdempotencyKey, "userId", command.User.UserId)
+		return nil
+	}
+
+	// A create whose user exists was applied by an earlier delivery that failed before markApplied
+	if errApply := h.apply(command); errApply != nil {
+		if _, exists := errApply.(*UserExistsError); !exists {
+			return errApply
+		}
+		logger().Info("User command already applied", "operation", "ApplyUserCommand", "table", h.TableName, "idempotencyKey", command.IdempotencyKey, "userId", command.User.UserId)
+	}
+
+	return h.markApplied(ctx, command)
+}
+
+//apply the command through the CRUD functions
+func (h *UserCommandHandler) apply(command UserCommand) error {
+
+	if command.User.UserId == "" {
+		return errors.New("UserIdRequired")
+	}
+
+	switch command.Operation {
+	case OperationCreate:
+		_, err := CreateNewUser(h.TableName, command.User)
+		return err
+	case OperationUpdate:
+		_, err := UpdateUserInfo(h.TableName, command.User)
+		return err
+	case OperationDelete:
+		return DeleteUser(command.User.UserId, h.TableName)
+	}
+	return errors.New("UnknownOperation" + ": " + command.Operation)
+}
+
+func (h *UserCommandHandler) initClient() {
+	if h.DynamoDB != nil {
+		return
+	}
+	region := "us-east-2"
+	awsSession, _ := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
+	h.DynamoDB = dynamodb.New(awsSession)
+}
+
+func (h *UserCommandHandler) alreadyApplied(ctx context.Context, idempotencyKey string) (bool, error) {
+
+	if h.IdempotencyTableName == "" {
+		return false, nil
+	}
+	h.initClient()
+
+	keys := make(map[string]*dynamodb.AttributeValue)
+	itemKeyValue := dynamodb.AttributeValue{S: aws.String(idempotencyKey)}
+	keys["idempotencyKey"] = &itemKeyValue
+
+	getItemInput := dynamodb.GetItemInput{TableName: aws.String(h.IdempotencyTableName), Key: keys, ConsistentRead: aws.Bool(true)}
+	response, errFromLookup := h.DynamoDB.GetItemWithContext(ctx, &getItemInput)
+	if errFromLookup != nil {
+		return false, errors.New("FailedTableLookupError" + "[" + errFromLookup.Error() + "]")
+	}
+	if response.Item == nil {
+		return false, nil
+	}
+
+	// Items past their TTL may not have been deleted yet
+	if expiresAt, ok := response.Item["expiresAt"]; ok && expiresAt.N != nil {
+		expires, _ := strconv.ParseInt(*expiresAt.N, 10, 64)
+		return expires > time.Now().Unix(), nil
+	}
+	return true, nil
+}
+
+func (h *UserCommandHandler) markApplied(ctx context.Context, command UserCommand) error {
+
+	if h.IdempotencyTableName == "" {
+		return nil
+	}
+	h.initClient()
+
+	ttl := h.IdempotencyTTL
+	if ttl == 0 {
+		ttl = 24 * time.Hour
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(h.IdempotencyTableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			"idempotencyKey": {S: aws.String(command.IdempotencyKey)},
+			"operation":      {S: aws.String(command.Operation)},
+			"userId":         {S: aws.String(command.User.UserId)},
+			"expiresAt":      {N: aws.String(strconv.FormatInt(time.Now().Add(ttl).Unix(), 10))},
+		},
+	}
+
+	_, errPutItem := h.DynamoDB.PutItemWithContext(ctx, input)
+	if errPutItem != nil {
+		return errors.New("Put Item Error" + "[" + errPutItem.Error() + "]")
+	}
+	return nil
+}
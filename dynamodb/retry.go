@@ -0,0 +1,192 @@
+package main
+
+//go:generate sh ../sync-shared.sh
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+//Environment variables configuring the retry policy of AWS requests
+const (
+	RetryMaxAttemptsEnv = "RETRY_MAX_ATTEMPTS"
+	RetryBaseDelayEnv   = "RETRY_BASE_DELAY"
+	RetryMaxDelayEnv    = "RETRY_MAX_DELAY"
+	RetryBudgetEnv      = "RETRY_BUDGET"
+)
+
+//RetryPolicy of AWS requests. Delays use exponential backoff with full jitter
+type RetryPolicy struct {
+
+	// Attempts including the first one, 5 when zero
+	MaxAttempts int
+
+	// Delay ceiling of the first retry, doubled for every following one, 50ms when zero
+	BaseDelay time.Duration
+
+	// Upper bound of a single delay, 5s when zero
+	MaxDelay time.Duration
+
+	// Total time a request may spend retrying, unlimited when zero
+	Budget time.Duration
+
+	// Time kept free before the Lambda deadline, no retry is started after it. 500ms when zero
+	DeadlineMargin time.Duration
+
+	// Classifies errors as retryable, DefaultRetryable when nil
+	Retryable func(err error) bool
+}
+
+var (
+	retryMu          sync.RWMutex
+	retryPolicy      = RetryPolicyFromEnv()
+	retryDeadline    time.Time
+	retryRandom      = rand.New(rand.NewSource(time.Now().UnixNano()))
+	retryRandomMutex sync.Mutex
+)
+
+//RetryPolicyFromEnv reads the RETRY_* variables, durations as accepted by time.ParseDuration
+func RetryPolicyFromEnv() RetryPolicy {
+	policy := RetryPolicy{}
+	if value, err := strconv.Atoi(os.Getenv(RetryMaxAttemptsEnv)); err == nil {
+		policy.MaxAttempts = value
+	}
+	if value, err := time.ParseDuration(os.Getenv(RetryBaseDelayEnv)); err == nil {
+		policy.BaseDelay = value
+	}
+	if value, err := time.ParseDuration(os.Getenv(RetryMaxDelayEnv)); err == nil {
+		policy.MaxDelay = value
+	}
+	if value, err := time.ParseDuration(os.Getenv(RetryBudgetEnv)); err == nil {
+		policy.Budget = value
+	}
+	return policy
+}
+
+//SetRetryPolicy used by the sessions created afterwards
+func SetRetryPolicy(policy RetryPolicy) {
+	retryMu.Lock()
+	defer retryMu.Unlock()
+	retryPolicy = policy
+}
+
+//DefaultRetryable retries throttling, server side and connection errors
+func DefaultRetryable(err error) bool {
+	if failure, ok := err.(awserr.RequestFailure); ok && failure.StatusCode() >= 500 && failure.StatusCode() != 501 {
+		return true
+	}
+	return request.IsErrorThrottle(err) || request.IsErrorRetryable(err)
+}
+
+//setRetryDeadline of the invocation in ctx, retries are not started past it
+func setRetryDeadline(ctx context.Context) {
+	deadline, _ := ctx.Deadline()
+
+	retryMu.Lock()
+	defer retryMu.Unlock()
+	retryDeadline = deadline
+}
+
+//retrySession applies the retry policy to the clients of the session
+func retrySession(awsSession *session.Session) {
+	if awsSession == nil {
+		return
+	}
+	retryMu.RLock()
+	defer retryMu.RUnlock()
+	awsSession.Config.Retryer = policyRetryer{policy: retryPolicy.withDefaults()}
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 5
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = 50 * time.Millisecond
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = 5 * time.Second
+	}
+	if p.DeadlineMargin <= 0 {
+		p.DeadlineMargin = 500 * time.Millisecond
+	}
+	if p.Retryable == nil {
+		p.Retryable = DefaultRetryable
+	}
+	return p
+}
+
+//policyRetryer implements request.Retryer for a RetryPolicy
+type policyRetryer struct {
+	policy RetryPolicy
+}
+
+//MaxRetries after the first attempt
+func (p policyRetryer) MaxRetries() int {
+	return p.policy.MaxAttempts - 1
+}
+
+//ShouldRetry when the error is retryable and the budget and Lambda deadline leave time for it
+func (p policyRetryer) ShouldRetry(r *request.Request) bool {
+	if p.policy.Budget > 0 && time.Since(r.Time) >= p.policy.Budget {
+		return false
+	}
+	if remaining, ok := p.remaining(r); ok && remaining <= 0 {
+		return false
+	}
+
+	// Set by the SDK for throttles and 5xx errors, or by a handler of the client
+	if r.Retryable != nil {
+		return *r.Retryable
+	}
+	return r.Error != nil && p.policy.Retryable(r.Error)
+}
+
+//RetryRules returns a random delay up to min(MaxDelay, BaseDelay * 2^retry), cut to the time left
+func (p policyRetryer) RetryRules(r *request.Request) time.Duration {
+	ceiling := p.policy.BaseDelay << uint(r.RetryCount)
+	if ceiling <= 0 || ceiling > p.policy.MaxDelay {
+		ceiling = p.policy.MaxDelay
+	}
+
+	retryRandomMutex.Lock()
+	delay := time.Duration(retryRandom.Int63n(int64(ceiling) + 1))
+	retryRandomMutex.Unlock()
+
+	if remaining, ok := p.remaining(r); ok && delay > remaining {
+		delay = remaining
+	}
+	return delay
+}
+
+//remaining time for retries before the budget or the Lambda deadline less its margin runs out
+func (p policyRetryer) remaining(r *request.Request) (time.Duration, bool) {
+
+	deadline, ok := r.Context().Deadline()
+	if !ok {
+		retryMu.RLock()
+		deadline = retryDeadline
+		retryMu.RUnlock()
+		ok = !deadline.IsZero()
+	}
+
+	var remaining time.Duration
+	if ok {
+		remaining = time.Until(deadline) - p.policy.DeadlineMargin
+	}
+	if p.policy.Budget > 0 {
+		left := p.policy.Budget - time.Since(r.Time)
+		if !ok || left < remaining {
+			remaining, ok = left, true
+		}
+	}
+	return remaining, ok
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+//tableDimensions of a metric for an operation on a table
+func tableDimensions(operation, tableName string) map[string]string {
+	return map[string]string{"Operation": operation, "Table": tableName}
+}
+
+//recordCall emits the latency of a DynamoDB call, and its error type and throttling on failure
+func recordCall(operation, tableName string, start time.Time, err error) {
+	putMetric("Latency", float64(sinceMs(start)), UnitMilliseconds, tableDimensions(operation, tableName))
+	if err == nil {
+		return
+	}
+
+	errorDimensions := tableDimensions(operation, tableName)
+	errorDimensions["ErrorType"] = errorType(err)
+	putMetric("Errors", 1, UnitCount, errorDimensions)
+	if isThrottle(err) {
+		putMetric("Throttles", 1, UnitCount, tableDimensions(operation, tableName))
+	}
+}
+
+//recordCapacity emits the capacity units consumed by a call made with ReturnConsumedCapacity TOTAL
+func recordCapacity(operation, tableName string, capacities ...*dynamodb.ConsumedCapacity) {
+	units := 0.0
+	for _, capacity := range capacities {
+		if capacity != nil {
+			units += aws.Float64Value(capacity.CapacityUnits)
+		}
+	}
+	putMetric("ConsumedCapacity", units, UnitCount, tableDimensions(operation, tableName))
+}
+
+//recordItemCount emits the number of items returned or written
+func recordItemCount(operation, tableName string, count int) {
+	putMetric("ItemCount", float64(count), UnitCount, tableDimensions(operation, tableName))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+//paramAttributes of the tables, key, bucket or topic a request is made for
+func paramAttributes(params reflect.Value) []attribute.KeyValue {
+
+	var attributes []attribute.KeyValue
+
+	var tables []string
+	if table := stringParam(params, "TableName"); table != "" {
+		tables = append(tables, table)
+	}
+	if items := params.FieldByName("RequestItems"); items.IsValid() && items.Kind() == reflect.Map {
+		for _, table := range items.MapKeys() {
+			tables = append(tables, table.String())
+		}
+		sort.Strings(tables)
+	}
+	if len(tables) > 0 {
+		attributes = append(attributes, attribute.StringSlice("aws.dynamodb.table_names", tables))
+	}
+	if index := stringParam(params, "IndexName"); index != "" {
+		attributes = append(attributes, attribute.String("aws.dynamodb.index_name", index))
+	}
+
+	// Key is the item key for DynamoDB and the object key for S3
+	if key := params.FieldByName("Key"); key.IsValid() {
+		if itemKey, ok := key.Interface().(map[string]*dynamodb.AttributeValue); ok && len(itemKey) > 0 {
+			attributes = append(attributes, attribute.String("aws.dynamodb.key", formatItemKey(itemKey)))
+		}
+	}
+	if bucket := stringParam(params, "Bucket"); bucket != "" {
+		attributes = append(attributes, attribute.String("aws.s3.bucket", bucket))
+	}
+	if objectKey := stringParam(params, "Key"); objectKey != "" {
+		attributes = append(attributes, attribute.String("aws.s3.key", objectKey))
+	}
+	if topic := stringParam(params, "TopicArn"); topic != "" {
+		attributes = append(attributes, attribute.String("messaging.destination.name", topic))
+	}
+	return attributes
+}
+
+//formatItemKey as "name=value" pairs sorted by name
+func formatItemKey(itemKey map[string]*dynamodb.AttributeValue) string {
+	pairs := make([]string, 0, len(itemKey))
+	for name, value := range itemKey {
+		switch {
+		case value.S != nil:
+			pairs = append(pairs, name+"="+*value.S)
+		case value.N != nil:
+			pairs = append(pairs, name+"="+*value.N)
+		default:
+			pairs = append(pairs, name+"=?")
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
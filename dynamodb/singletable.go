@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+)
+
+//Key prefixes of the single table design
+const (
+	UserKeyPrefix  = "USER#"
+	GroupKeyPrefix = "GROUP#"
+	BatchKeyPrefix = "BATCH#"
+)
+
+//Entity types, stored in the "type" attribute of every item
+const (
+	EntityUser       = "User"
+	EntityGroup      = "Group"
+	EntityBatch      = "Batch"
+	EntityMembership = "GroupMembership"
+	EntityBatchGroup = "BatchGroup"
+)
+
+//UserKey, GroupKey and BatchKey of the entities
+func UserKey(userID string) string { return UserKeyPrefix + userID }
+
+func GroupKey(group string) string { return GroupKeyPrefix + group }
+
+func BatchKey(batchID string) string { return BatchKeyPrefix + batchID }
+
+//Group entity
+type Group struct {
+	Name        string `json:"group"`
+	Description string `json:"description,omitempty"`
+
+	// Users of the batch in the group, set on the group edges of batches
+	Members int64 `json:"members,omitempty"`
+}
+
+//Batch entity
+type Batch struct {
+	BatchID     string `json:"batchId"`
+	Description string `json:"description,omitempty"`
+}
+
+//Entities of a query result decoded by their type
+type Entities struct {
+
+	// Users and group memberships, which copy the user
+	Users []UserInfoAdvanced
+
+	// Groups and the group edges of batches
+	Groups []Group
+
+	Batches []Batch
+
+	// Items of other types, e.g. written by a newer version
+	Unknown []map[string]*dynamodb.AttributeValue
+}
+
+//entityKeys written on every item. The inverted index swaps PK and SK for the reverse adjacency
+//queries, e.g. the groups of a user
+type entityKeys struct {
+	PK     string `json:"PK"`
+	SK     string `json:"SK"`
+	Type   string `json:"type"`
+	GSI1PK string `json:"GSI1PK"`
+	GSI1SK string `json:"GSI1SK"`
+}
+
+//SingleTable stores users, groups and batches in one table with the "PK" and "SK" string keys
+//and an inverted index with the "GSI1PK" and "GSI1SK" keys:
+//
+//	PK            SK            type
+//	USER#<id>     USER#<id>     User
+//	GROUP#<g>     GROUP#<g>     Group
+//	GROUP#<g>     USER#<id>     GroupMembership
+//	BATCH#<b>     BATCH#<b>     Batch
+//	BATCH#<b>     GROUP#<g>     BatchGroup, with the members count of the edge
+type SingleTable struct {
+	TableName string
+
+	// Inverted index, "GSI1" when empty
+	InvertedIndex string
+
+	// Client, created from the default region when nil
+	DynamoDB dynamodbiface.DynamoDBAPI
+}
+
+//maxPutUserAttempts of PutUser when the user changes between its read and its write
+const maxPutUserAttempts = 3
+
+//PutUser writes the user with its group membership and the group edge of its batch in one
+//transaction. The membership copies the user and is rewritten with the profile on every put.
+//When the group or batch changed, the previous membership is deleted and the previous edge
+//released in the same transaction, conditioned on the profile still having them
+func (t *SingleTable) PutUser(ctx context.Context, user UserInfoAdvanced) error {
+
+	start := time.Now()
+	opLogger := logger().With("operation", "PutUser", "table", t.TableName, "userId", user.UserId, "group", user.Group, "batchId", user.BatchID)
+
+	if errValidate := Validate(user); errValidate != nil {
+		opLogger.Warn("ValidationError", "error", errValidate.Error(), "durationMs", sinceMs(start))
+		return errValidate
+	}
+	t.initClient()
+
+	var errWrite error
+	for attempt := 1; attempt <= maxPutUserAttempts; attempt++ {
+		previous, found, errRead := t.currentUser(ctx, user.UserId)
+		if errRead != nil {
+			recordCall("PutUser", t.TableName, start, errRead)
+			if _, open := errRead.(*CircuitOpenError); open {
+				opLogger.Warn("CircuitOpen", "error", errRead.Error(), "durationMs", sinceMs(start))
+				return errRead
+			}
+			opLogger.Error("FailedTableLookupError", "error", errRead.Error(), "durationMs", sinceMs(start))
+			return errors.New("FailedTableLookupError" + "[" + errRead.Error() + "]")
+		}
+
+		transactItems, errItems := t.userWrites(user, previous, found)
+		if errItems != nil {
+			opLogger.Error("Marshal Map Error", "error", errItems.Error(), "durationMs", sinceMs(start))
+			return errItems
+		}
+
+		var output *dynamodb.TransactWriteItemsOutput
+		output, errWrite = t.DynamoDB.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems:          transactItems,
+			ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+		})
+		if errWrite == nil {
+			recordCall("PutUser", t.TableName, start, nil)
+			recordCapacity("PutUser", t.TableName, output.ConsumedCapacity...)
+			recordItemCount("PutUser", t.TableName, len(transactItems))
+			opLogger.Info("Items Written Successfully", "count", len(transactItems), "attempts", attempt, "durationMs", sinceMs(start))
+			return nil
+		}
+		if !profileChanged(errWrite) {
+			break
+		}
+		opLogger.Warn("User changed during PutUser, retrying", "attempt", attempt)
+	}
+
+	recordCall("PutUser", t.TableName, start, errWrite)
+	if _, open := errWrite.(*CircuitOpenError); open {
+		opLogger.Warn("CircuitOpen", "error", errWrite.Error(), "durationMs", sinceMs(start))
+		return errWrite
+	}
+	opLogger.Error("Put Item Error", "error", errWrite.Error(), "durationMs", sinceMs(start))
+	return errors.New("Put Item Error" + "[" + errWrite.Error() + "]")
+}
+
+//currentUser profile, read consistently before a PutUser
+func (t *SingleTable) currentUser(ctx context.Context, userID string) (UserInfoAdvanced, bool, error) {
+	var user UserInfoAdvanced
+	output, errGet := t.DynamoDB.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(t.TableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {S: aws.String(UserKey(userID))},
+			"SK": {S: aws.String(UserKey(userID))},
+		},
+		ProjectionExpression:     aws.String("#group, batchId"),
+		ExpressionAttributeNames: map[string]*string{"#group": aws.String("group")},
+		ConsistentRead:           aws.Bool(true),
+	})
+	if errGet != nil || output.Item == nil {
+		return user, false, errGet
+	}
+	errUnmarshal := dynamodbattribute.UnmarshalMap(output.Item, &user)
+	return user, errUnmarshal == nil, errUnmarshal
+}
+
+//userWrites of PutUser given the previous profile
+func (t *SingleTable) userWrites(user, previous UserInfoAdvanced, found bool) ([]*dynamodb.TransactWriteItem, error) {
+
+	profile, errProfile := entityItem(entityKeys{PK: UserKey(user.UserId), SK: UserKey(user.UserId), Type: EntityUser}, user)
+	if errProfile != nil {
+		return nil, errProfile
+	}
+
+	// The profile must still have the group and batch the other writes were derived from
+	condition := expression.AttributeNotExists(expression.Name("PK"))
+	if found {
+		condition = sameOrMissing("group", previous.Group).And(sameOrMissing("batchId", previous.BatchID))
+	}
+	expr, errExpression := expression.NewBuilder().WithCondition(condition).Build()
+	if errExpression != nil {
+		return nil, errExpression
+	}
+	writes := []*dynamodb.TransactWriteItem{{Put: &dynamodb.Put{
+		TableName:                 aws.String(t.TableName),
+		Item:                      profile,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}}}
+
+	if user.Group != "" {
+		membership, errMembership := entityItem(entityKeys{PK: GroupKey(user.Group), SK: UserKey(user.UserId), Type: EntityMembership}, user)
+		if errMembership != nil {
+			return nil, errMembership
+		}
+		writes = append(writes, &dynamodb.TransactWriteItem{Put: &dynamodb.Put{TableName: aws.String(t.TableName), Item: membership}})
+	}
+	if previous.Group != "" && previous.Group != user.Group {
+		writes = append(writes, &dynamodb.TransactWriteItem{Delete: &dynamodb.Delete{
+			TableName: aws.String(t.TableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				"PK": {S: aws.String(GroupKey(previous.Group))},
+				"SK": {S: aws.String(UserKey(user.UserId))},
+			},
+		}})
+	}
+
+	// Edges are shared by the users of the batch in the group and count them
+	if user.Group != previous.Group || user.BatchID != previous.BatchID {
+		if user.Group != "" && user.BatchID != "" {
+			edge, errEdge := t.edgeUpdate(user.BatchID, user.Group, 1)
+			if errEdge != nil {
+				return nil, errEdge
+			}
+			writes = append(writes, edge)
+		}
+		if previous.Group != "" && previous.BatchID != "" {
+			edge, errEdge := t.edgeUpdate(previous.BatchID, previous.Group, -1)
+			if errEdge != nil {
+				return nil, errEdge
+			}
+			writes = append(writes, edge)
+		}
+	}
+	return writes, nil
+}
+
+//edgeUpdate adds delta to the members of the group edge of the batch, creating it when missing
+func (t *SingleTable) edgeUpdate(batchID, group string, delta int) (*dynamodb.TransactWriteItem, error) {
+	keys := entityKeys{PK: BatchKey(batchID), SK: GroupKey(group), Type: EntityBatchGroup}
+	update := expression.Set(expression.Name("type"), expression.Value(keys.Type)).
+		Set(expression.Name("GSI1PK"), expression.Value(keys.SK)).
+		Set(expression.Name("GSI1SK"), expression.Value(keys.PK)).
+		Set(expression.Name("group"), expression.Value(group)).
+		Add(expression.Name("members"), expression.Value(delta))
+	expr, errExpression := expression.NewBuilder().WithUpdate(update).Build()
+	if errExpression != nil {
+		return nil, errExpression
+	}
+	return &dynamodb.TransactWriteItem{Update: &dynamodb.Update{
+		TableName: aws.String(t.TableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {S: aws.String(keys.PK)},
+			"SK": {S: aws.String(keys.SK)},
+		},
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}}, nil
+}
+
+//sameOrMissing condition of an attribute read before a write, missing when it was empty
+func sameOrMissing(name, value string) expression.ConditionBuilder {
+	if value == "" {
+		return expression.AttributeNotExists(expression.Name(name))
+	}
+	return expression.Name(name).Equal(expression.Value(value))
+}
+
+//profileChanged when the profile condition of a PutUser transaction failed
+func profileChanged(err error) bool {
+	canceled, ok := err.(*dynamodb.TransactionCanceledException)
+	return ok && len(canceled.CancellationReasons) > 0 && aws.StringValue(canceled.CancellationReasons[0].Code) == "ConditionalCheckFailed"
+}
+
+//PutGroup writes the group
+func (t *SingleTable) PutGroup(ctx context.Context, group Group) error {
+	if errValidate := ValidateField("group", group.Name, groupRules); errValidate != nil {
+		return errValidate
+	}
+	item, errItem := entityItem(entityKeys{PK: GroupKey(group.Name), SK: GroupKey(group.Name), Type: EntityGroup}, group)
+	if errItem != nil {
+		return errItem
+	}
+	return t.putItem(ctx, "PutGroup", item)
+}
+
+//PutBatch writes the batch
+func (t *SingleTable) PutBatch(ctx context.Context, batch Batch) error {
+	if errValidate := ValidateField("batchId", batch.BatchID, batchRules); errValidate != nil {
+		return errValidate
+	}
+	item, errItem := entityItem(entityKeys{PK: BatchKey(batch.BatchID), SK: BatchKey(batch.BatchID), Type: EntityBatch}, batch)
+	if errItem != nil {
+		return errItem
+	}
+	return t.putItem(ctx, "PutBatch", item)
+}
+
+//UsersInGroup from the memberships of the group
+func (t *SingleTable) UsersInGroup(ctx context.Context, group string) ([]UserInfoAdvanced, error) {
+	entities, err := t.Query(ctx, GroupKey(group), UserKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return entities.Users, nil
+}
+
+//GroupsForBatch from the group edges of the batch that have members
+func (t *SingleTable) GroupsForBatch(ctx context.Context, batchID string) ([]Group, error) {
+	entities, err := t.Query(ctx, BatchKey(batchID), GroupKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Edges whose users all left are kept with no members
+	groups := entities.Groups[:0]
+	for _, group := range entities.Groups {
+		if group.Members > 0 {
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
+
+//GroupsOfUser through the inverted index, the memberships keyed by the user
+func (t *SingleTable) GroupsOfUser(ctx context.Context, userID string) ([]string, error) {
+	entities, err := t.QueryInverted(ctx, UserKey(userID), GroupKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0, len(entities.Users))
+	for _, membership := range entities.Users {
+		groups = append(groups, membership.Group)
+	}
+	return groups, nil
+}
+
+//Query the item collection of the partition key, restricted to sort keys starting with
+//skPrefix when set, and decode the items by their type
+func (t *SingleTable) Query(ctx context.Context, pk, skPrefix string) (Entities, error) {
+	return t.query(ctx, "", "PK", "SK", pk, skPrefix)
+}
+
+//QueryInverted is Query through the inverted index, e.g. QueryInverted(ctx, UserKey(id), GroupKeyPrefix)
+//for the memberships of a user
+func (t *SingleTable) QueryInverted(ctx context.Context, pk, skPrefix string) (Entities, error) {
+	index := t.InvertedIndex
+	if index == "" {
+		index = "GSI1"
+	}
+	return t.query(ctx, index, "GSI1PK", "GSI1SK", pk, skPrefix)
+}
+
+func (t *SingleTable) query(ctx context.Context, index, pkName, skName, pk, skPrefix string) (Entities, error) {
+
+	start := time.Now()
+	opLogger := logger().With("operation", "QuerySingleTable", "table", t.TableName, "index", index, "pk", pk, "skPrefix", skPrefix)
+	t.initClient()
+
+	var entities Entities
+
+	keyCondition := expression.Key(pkName).Equal(expression.Value(pk))
+	if skPrefix != "" {
+		keyCondition = keyCondition.And(expression.Key(skName).BeginsWith(skPrefix))
+	}
+	expr, errExpression := expression.NewBuilder().WithKeyCondition(keyCondition).Build()
+	if errExpression != nil {
+		opLogger.Error("Query Expression Error", "error", errExpression.Error(), "durationMs", sinceMs(start))
+		return entities, errExpression
+	}
+
+	var queryInput = &dynamodb.QueryInput{
+		TableName:                 aws.String(t.TableName),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnConsumedCapacity:    aws.String(dynamodb.ReturnConsumedCapacityTotal),
+	}
+	if index != "" {
+		queryInput.IndexName = aws.String(index)
+	}
+
+	var errDecode error
+	errQueryDynamoDB := t.DynamoDB.QueryPagesWithContext(ctx, queryInput, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		recordCapacity("QuerySingleTable", t.TableName, page.ConsumedCapacity)
+		errDecode = entities.decode(page.Items)
+		return errDecode == nil
+	})
+	recordCall("QuerySingleTable", t.TableName, start, errQueryDynamoDB)
+	if errQueryDynamoDB != nil {
+		opLogger.Error("FailedTableLookupError", "error", errQueryDynamoDB.Error(), "durationMs", sinceMs(start))
+		return entities, errors.New("FailedTableLookupError" + "[" + errQueryDynamoDB.Error() + "]")
+	}
+	if errDecode != nil {
+		opLogger.Error("UnMarshal Error", "error", errDecode.Error(), "durationMs", sinceMs(start))
+		return entities, errDecode
+	}
+
+	opLogger.Info("Successfully Fetched", "users", len(entities.Users), "groups", len(entities.Groups), "batches", len(entities.Batches), "durationMs", sinceMs(start))
+	return entities, nil
+}
+
+//DecodeEntities of a query result by their type
+func DecodeEntities(items []map[string]*dynamodb.AttributeValue) (Entities, error) {
+	var entities Entities
+	err := entities.decode(items)
+	return entities, err
+}
+
+func (e *Entities) decode(items []map[string]*dynamodb.AttributeValue) error {
+	for _, item := range items {
+		var target interface{}
+		switch itemString(item, "type") {
+		case EntityUser, EntityMembership:
+			e.Users = append(e.Users, UserInfoAdvanced{})
+			target = &e.Users[len(e.Users)-1]
+		case EntityGroup, EntityBatchGroup:
+			e.Groups = append(e.Groups, Group{})
+			target = &e.Groups[len(e.Groups)-1]
+		case EntityBatch:
+			e.Batches = append(e.Batches, Batch{})
+			target = &e.Batches[len(e.Batches)-1]
+		default:
+			// Includes items without a type
+			e.Unknown = append(e.Unknown, item)
+			continue
+		}
+		if errUnmarshal := dynamodbattribute.UnmarshalMap(item, target); errUnmarshal != nil {
+			return errors.New("ItemUnMarshalError" + "[" + itemString(item, "PK") + " " + itemString(item, "SK") + ": " + errUnmarshal.Error() + "]")
+		}
+	}
+	return nil
+}
+
+//itemString value of a string attribute of the item, empty when missing
+func itemString(item map[string]*dynamodb.AttributeValue, name string) string {
+	if value, ok := item[name]; ok && value != nil {
+		return aws.StringValue(value.S)
+	}
+	return ""
+}
+
+//entityItem of the entity with its keys
+func entityItem(keys entityKeys, entity interface{}) (map[string]*dynamodb.AttributeValue, error) {
+	item, errMarshal := dynamodbattribute.MarshalMap(entity)
+	if errMarshal != nil {
+		return nil, errors.New("Marshal Map Error" + "[" + errMarshal.Error() + "]")
+	}
+	keys.GSI1PK, keys.GSI1SK = keys.SK, keys.PK
+	keyItem, errMarshal := dynamodbattribute.MarshalMap(keys)
+	if errMarshal != nil {
+		return nil, errors.New("Marshal Map Error" + "[" + errMarshal.Error() + "]")
+	}
+	for name, value := range keyItem {
+		item[name] = value
+	}
+	return item, nil
+}
+
+//putItem of a group or batch
+func (t *SingleTable) putItem(ctx context.Context, operation string, item map[string]*dynamodb.AttributeValue) error {
+
+	start := time.Now()
+	opLogger := logger().With("operation", operation, "table", t.TableName, "pk", itemString(item, "PK"))
+	t.initClient()
+
+	output, errPut := t.DynamoDB.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:              aws.String(t.TableName),
+		Item:                   item,
+		ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+	})
+	recordCall(operation, t.TableName, start, errPut)
+	if errPut != nil {
+		errorString := "Put Item Error" + "[" + errPut.Error() + "]"
+		opLogger.Error("Put Item Error", "error", errPut.Error(), "durationMs", sinceMs(start))
+		return errors.New(errorString)
+	}
+
+	recordCapacity(operation, t.TableName, output.ConsumedCapacity)
+	recordItemCount(operation, t.TableName, 1)
+	opLogger.Info("Item Written Successfully", "durationMs", sinceMs(start))
+	return nil
+}
+
+func (t *SingleTable) initClient() {
+	if t.DynamoDB != nil {
+		return
+	}
+	region := "us-east-2"
+	awsSession, _ := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
+	t.DynamoDB = dynamodb.New(awsSession)
+}
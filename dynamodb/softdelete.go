@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+)
+
+//Environment variables configuring soft delete
+const (
+	SoftDeleteEnv          = "SOFT_DELETE"
+	SoftDeleteRetentionEnv = "SOFT_DELETE_RETENTION"
+)
+
+//SoftDeletePolicy of DeleteUser
+type SoftDeletePolicy struct {
+
+	// DeleteUser marks users deleted instead of removing them
+	Enabled bool
+
+	// Time after the delete the item is purged through the table TTL, kept until restored when zero
+	Retention time.Duration
+}
+
+var (
+	softDeleteMu     sync.RWMutex
+	softDeletePolicy = SoftDeletePolicyFromEnv()
+)
+
+//SoftDeletePolicyFromEnv reads SOFT_DELETE ("true" enables it) and SOFT_DELETE_RETENTION,
+//a duration as accepted by time.ParseDuration
+func SoftDeletePolicyFromEnv() SoftDeletePolicy {
+	policy := SoftDeletePolicy{}
+	policy.Enabled, _ = strconv.ParseBool(os.Getenv(SoftDeleteEnv))
+	if value, err := time.ParseDuration(os.Getenv(SoftDeleteRetentionEnv)); err == nil {
+		policy.Retention = value
+	}
+	return policy
+}
+
+//SetSoftDeletePolicy used by DeleteUser
+func SetSoftDeletePolicy(policy SoftDeletePolicy) {
+	softDeleteMu.Lock()
+	defer softDeleteMu.Unlock()
+	softDeletePolicy = policy
+}
+
+func currentSoftDeletePolicy() SoftDeletePolicy {
+	softDeleteMu.RLock()
+	defer softDeleteMu.RUnlock()
+	return softDeletePolicy
+}
+
+//SoftDeleteUser marks the user deleted. Reads skip it until RestoreUser is called, and the
+//table TTL purges it after the retention of the soft delete policy
+func SoftDeleteUser(userID, userTableName string) error {
+	start := time.Now()
+	opLogger := logger().With("operation", "SoftDeleteUser", "table", userTableName, "userId", userID)
+
+	if errValidate := ValidateField("userId", userID, userIDRules); errValidate != nil {
+		opLogger.Warn("ValidationError", "error", errValidate.Error(), "durationMs", sinceMs(start))
+		return errValidate
+	}
+
+	region := "us-east-2"
+	awsSession, _ := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
+
+	dynaClient := dynamodb.New(awsSession)
+
+	now := auditTimestamp()
+	changes := map[string]interface{}{"deletedAt": now, "updatedAt": now}
+	update := expression.Set(expression.Name("deletedAt"), expression.Value(now)).
+		Set(expression.Name("updatedAt"), expression.Value(now))
+	if retention := currentSoftDeletePolicy().Retention; retention > 0 {
+		changes[ttlAttribute] = time.Now().Add(retention).Unix()
+		update = update.Set(expression.Name(ttlAttribute), expression.Value(changes[ttlAttribute]))
+	}
+	expr, errExpression := expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(expression.AttributeExists(expression.Name("userId"))).
+		Build()
+	if errExpression != nil {
+		opLogger.Error("Update Expression Error", "error", errExpression.Error(), "durationMs", sinceMs(start))
+		return errExpression
+	}
+
+	keys := make(map[string]*dynamodb.AttributeValue)
+	itemKeyValue := dynamodb.AttributeValue{S: aws.String(userID)}
+	keys["userId"] = &itemKeyValue
+
+	input := &dynamodb.UpdateItemInput{
+		Key:                       keys,
+		TableName:                 aws.String(userTableName),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnConsumedCapacity:    aws.String(dynamodb.ReturnConsumedCapacityTotal),
+	}
+
+	// With an audit table the update and its audit entry are written in one transaction
+	updateOutput := &dynamodb.UpdateItemOutput{}
+	var errUpdateItem error
+	if currentAuditTable() != "" {
+		_, updateOutput.ConsumedCapacity, errUpdateItem = writeAudited(dynaClient, "SoftDeleteUser", userTableName, userID, transactUpdate(input),
+			func(before map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+				return auditImage(before, changes)
+			})
+	} else {
+		updateOutput, errUpdateItem = dynaClient.UpdateItem(input)
+	}
+	recordCall("SoftDeleteUser", userTableName, start, errUpdateItem)
+	if errUpdateItem != nil {
+		if _, open := errUpdateItem.(*CircuitOpenError); open {
+			opLogger.Warn("CircuitOpen", "error", errUpdateItem.Error(), "durationMs", sinceMs(start))
+			return errUpdateItem
+		}
+		if awsErr, ok := errUpdateItem.(awserr.Error); ok && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			opLogger.Warn("UserNotFound", "durationMs", sinceMs(start))
+			return errors.New("UserNotFound" + ": " + userID)
+		}
+		errorString := "Failed to Delete" + "[" + errUpdateItem.Error() + "]"
+		opLogger.Error("Failed to Delete", "error", errUpdateItem.Error(), "durationMs", sinceMs(start))
+		return errors.New(errorString)
+	}
+	recordCapacity("SoftDeleteUser", userTableName, updateOutput.ConsumedCapacity)
+	recordItemCount("SoftDeleteUser", userTableName, 1)
+	opLogger.Info("User Soft Deleted Successfully", "durationMs", sinceMs(start))
+	publishUserEvent(UserDeleted, userID, nil)
+	return nil
+}
+
+//RestoreUser undoes SoftDeleteUser, cancelling the purge. The user no longer expires, call
+//SetUserTTL again for temporary users
+func RestoreUser(userID, userTableName string) (UserInfo, error) {
+	start := time.Now()
+	opLogger := logger().With("operation", "RestoreUser", "table", userTableName, "userId", userID)
+
+	var userInfo UserInfo
+	if errValidate := ValidateField("userId", userID, userIDRules); errValidate != nil {
+		opLogger.Warn("ValidationError", "error", errValidate.Error(), "durationMs", sinceMs(start))
+		return userInfo, errValidate
+	}
+
+	region := "us-east-2"
+	awsSession, _ := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
+
+	dynaClient := dynamodb.New(awsSession)
+
+	now := auditTimestamp()
+	update := expression.Remove(expression.Name("deletedAt")).
+		Remove(expression.Name(ttlAttribute)).
+		Set(expression.Name("updatedAt"), expression.Value(now))
+	expr, errExpression := expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(expression.AttributeExists(expression.Name("deletedAt"))).
+		Build()
+	if errExpression != nil {
+		opLogger.Error("Update Expression Error", "error", errExpression.Error(), "durationMs", sinceMs(start))
+		return userInfo, errExpression
+	}
+
+	keys := make(map[string]*dynamodb.AttributeValue)
+	itemKeyValue := dynamodb.AttributeValue{S: aws.String(userID)}
+	keys["userId"] = &itemKeyValue
+
+	input := &dynamodb.UpdateItemInput{
+		Key:                       keys,
+		TableName:                 aws.String(userTableName),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
+		ReturnConsumedCapacity:    aws.String(dynamodb.ReturnConsumedCapacityTotal),
+	}
+
+	// With an audit table the update and its audit entry are written in one transaction
+	updateOutput := &dynamodb.UpdateItemOutput{}
+	var errUpdateItem error
+	if currentAuditTable() != "" {
+		updateOutput.Attributes, updateOutput.ConsumedCapacity, errUpdateItem = writeAudited(dynaClient, "RestoreUser", userTableName, userID, transactUpdate(input),
+			func(before map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+				return auditImage(before, map[string]interface{}{"updatedAt": now}, "deletedAt", ttlAttribute)
+			})
+	} else {
+		updateOutput, errUpdateItem = dynaClient.UpdateItem(input)
+	}
+	recordCall("RestoreUser", userTableName, start, errUpdateItem)
+	if errUpdateItem != nil {
+		if _, open := errUpdateItem.(*CircuitOpenError); open {
+			opLogger.Warn("CircuitOpen", "error", errUpdateItem.Error(), "durationMs", sinceMs(start))
+			return userInfo, errUpdateItem
+		}
+		if awsErr, ok := errUpdateItem.(awserr.Error); ok && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			opLogger.Warn("DeletedUserNotFound", "durationMs", sinceMs(start))
+			return userInfo, errors.New("DeletedUserNotFound" + ": " + userID)
+		}
+		errorString := "RestoreError" + "[" + errUpdateItem.Error() + "]"
+		opLogger.Error("RestoreError", "error", errUpdateItem.Error(), "durationMs", sinceMs(start))
+		return userInfo, errors.New(errorString)
+	}
+	recordCapacity("RestoreUser", userTableName, updateOutput.ConsumedCapacity)
+
+	errFromItemUnmarshal := dynamodbattribute.UnmarshalMap(updateOutput.Attributes, &userInfo)
+	if errFromItemUnmarshal != nil {
+		errorString := "ItemUnMarshalError" + ": " + userID
+		opLogger.Error("ItemUnMarshalError", "error", errFromItemUnmarshal.Error(), "durationMs", sinceMs(start))
+		return userInfo, errors.New(errorString)
+	}
+
+	recordItemCount("RestoreUser", userTableName, 1)
+	opLogger.Info("User Restored Successfully", "durationMs", sinceMs(start))
+	publishUserEvent(UserRestored, userID, &userInfo)
+	return userInfo, nil
+}
+
+//ListDeletedUsers soft deleted and not yet purged
+func ListDeletedUsers(tableName string) ([]UserInfo, error) {
+
+	start := time.Now()
+	opLogger := logger().With("operation", "ListDeletedUsers", "table", tableName)
+
+	users := []UserInfo{}
+	region := "us-east-2"
+	awsSession, _ := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
+
+	dynaClient := dynamodb.New(awsSession)
+
+	expr, errExpression := expression.NewBuilder().
+		WithFilter(expression.AttributeExists(expression.Name("deletedAt")).And(notExpired())).
+		Build()
+	if errExpression != nil {
+		opLogger.Error("Query Expression Error", "error", errExpression.Error(), "durationMs", sinceMs(start))
+		return users, errExpression
+	}
+
+	var queryInput = &dynamodb.ScanInput{
+		TableName:                 aws.String(tableName),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnConsumedCapacity:    aws.String(dynamodb.ReturnConsumedCapacityTotal),
+	}
+
+	// Few items pass the filter, so every page of the table is scanned
+	var errUnMarshal error
+	errQueryDynamoDB := dynaClient.ScanPages(queryInput, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		recordCapacity("ListDeletedUsers", tableName, page.ConsumedCapacity)
+		var pageUsers []UserInfo
+		if errUnMarshal = dynamodbattribute.UnmarshalListOfMaps(page.Items, &pageUsers); errUnMarshal != nil {
+			return false
+		}
+		users = append(users, pageUsers...)
+		return true
+	})
+	recordCall("ListDeletedUsers", tableName, start, errQueryDynamoDB)
+	if errQueryDynamoDB != nil {
+		opLogger.Error("Failed to Lookup table", "error", errQueryDynamoDB.Error(), "durationMs", sinceMs(start))
+		return users, errQueryDynamoDB
+	}
+	if errUnMarshal != nil {
+		opLogger.Error("UnMarshal Users Error", "error", errUnMarshal.Error(), "durationMs", sinceMs(start))
+		return users, errUnMarshal
+	}
+
+	recordItemCount("ListDeletedUsers", tableName, len(users))
+	opLogger.Info("Successfully Fetched", "count", len(users), "durationMs", sinceMs(start))
+	return users, nil
+}
+
+//notDeleted filter condition of reads
+func notDeleted() expression.ConditionBuilder {
+	return expression.AttributeNotExists(expression.Name("deletedAt"))
+}
+
+//readable filter condition of reads, skipping soft deleted and expired users
+func readable() expression.ConditionBuilder {
+	return notDeleted().And(notExpired())
+}
+
+//creatable condition of creates, the ID is unused or held by a soft deleted or expired user
+//that DynamoDB has not removed yet
+func creatable() expression.ConditionBuilder {
+	return expression.Or(
+		expression.AttributeNotExists(expression.Name("userId")),
+		expression.AttributeExists(expression.Name("deletedAt")),
+		expression.AttributeExists(expression.Name(ttlAttribute)).And(
+			expression.Name(ttlAttribute).LessThanEqual(expression.Value(time.Now().Unix()))),
+	)
+}
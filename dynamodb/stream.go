@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+//ChangeType of a user stream record
+type ChangeType string
+
+//Stream event names
+const (
+	ChangeInsert ChangeType = "INSERT"
+	ChangeModify ChangeType = "MODIFY"
+	ChangeRemove ChangeType = "REMOVE"
+)
+
+//FieldChange of a single attribute between the old and new image
+type FieldChange struct {
+
+	// Attribute name, e.g. "firstName"
+	Field string
+
+	// Value before the change, nil when the attribute was absent
+	Old interface{}
+
+	// Value after the change, nil when the attribute was removed
+	New interface{}
+}
+
+//UserChangeEvent decoded from a DynamoDB stream record
+type UserChangeEvent struct {
+
+	// INSERT, MODIFY or REMOVE
+	Type ChangeType
+
+	// Stream record identifiers
+	EventID        string
+	SequenceNumber string
+
+	// Images of the item, nil when not present in the record (e.g. Old on INSERT)
+	Old *UserInfoAdvanced
+	New *UserInfoAdvanced
+
+	// Field level differences between Old and New
+	Changes []FieldChange
+}
+
+//OldUserInfo view of the old image
+func (e UserChangeEvent) OldUserInfo() *UserInfo {
+	return toUserInfo(e.Old)
+}
+
+//NewUserInfo view of the new image
+func (e UserChangeEvent) NewUserInfo() *UserInfo {
+	return toUserInfo(e.New)
+}
+
+//SoftDeleted when the change marks the user deleted, see SoftDeleteUser
+func (e UserChangeEvent) SoftDeleted() bool {
+	return e.Type == ChangeModify && e.Old != nil && e.New != nil && e.Old.DeletedAt == "" && e.New.DeletedAt != ""
+}
+
+//Restored when the change undoes a soft delete, see RestoreUser
+func (e UserChangeEvent) Restored() bool {
+	return e.Type == ChangeModify && e.Old != nil && e.New != nil && e.Old.DeletedAt != "" && e.New.DeletedAt == ""
+}
+
+//UserID of the changed user
+func (e UserChangeEvent) UserID() string {
+	if e.New != nil {
+		return e.New.UserId
+	}
+	if e.Old != nil {
+		return e.Old.UserId
+	}
+	return ""
+}
+
+//UserChangeHandler reacts to a user change, a returned error fails the stream record
+type UserChangeHandler func(ctx context.Context, change UserChangeEvent) error
+
+//UserStreamConsumer dispatches user table stream records to registered handlers.
+//The table stream must use the NEW_AND_OLD_IMAGES view type and the event source mapping
+//must enable ReportBatchItemFailures. Wire it into a Lambda with lambda.Start(consumer.Handle)
+type UserStreamConsumer struct {
+	handlers map[ChangeType][]UserChangeHandler
+}
+
+//On registers handler for the given change types, or for every change when none are given
+func (c *UserStreamConsumer) On(handler UserChangeHandler, changeTypes ...ChangeType) {
+	if c.handlers == nil {
+		c.handlers = make(map[ChangeType][]UserChangeHandler)
+	}
+	if len(changeTypes) == 0 {
+		changeTypes = []ChangeType{ChangeInsert, ChangeModify, ChangeRemove}
+	}
+	for _, changeType := range changeTypes {
+		c.handlers[changeType] = append(c.handlers[changeType], handler)
+	}
+}
+
+//Handle a batch of stream records. Records are processed in order and processing stops at the
+//first failure, which is reported so the batch is retried from that record onwards
+func (c *UserStreamConsumer) Handle(ctx context.Context, event events.DynamoDBEvent) (events.DynamoDBEventResponse, error) {
+	SetRequestContext(ctx)
+	defer FlushMetrics()
+	defer FlushTraces()
+
+	response := events.DynamoDBEventResponse{BatchItemFailures: []events.DynamoDBBatchItemFailure{}}
+
+	for _, record := range event.Records {
+		change, errDecode := DecodeUserChange(record)
+		if errDecode == nil {
+			errDecode = c.dispatch(ctx, change)
+		}
+		if errDecode != nil {
+			logger().Error("StreamRecordError", "operation", "ConsumeUserStream", "eventId", record.EventID, "sequenceNumber", record.Change.SequenceNumber, "error", errDecode.Error())
+			response.BatchItemFailures = append(response.BatchItemFailures, events.DynamoDBBatchItemFailure{
+				ItemIdentifier: record.Change.SequenceNumber,
+			})
+			return response, nil
+		}
+	}
+
+	logger().Info("Successfully Processed stream records", "operation", "ConsumeUserStream", "count", len(event.Records))
+	return response, nil
+}
+
+func (c *UserStreamConsumer) dispatch(ctx context.Context, change UserChangeEvent) error {
+	for _, handler := range c.handlers[change.Type] {
+		if err := handler(ctx, change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//DecodeUserChange classifies the stream record and decodes its images and field level diff
+func DecodeUserChange(record events.DynamoDBEventRecord) (UserChangeEvent, error) {
+
+	change := UserChangeEvent{
+		Type:           ChangeType(record.EventName),
+		EventID:        record.EventID,
+		SequenceNumber: record.Change.SequenceNumber,
+	}
+
+	switch change.Type {
+	case ChangeInsert, ChangeModify, ChangeRemove:
+	default:
+		return change, errors.New("UnknownStreamEvent" + ": " + record.EventName)
+	}
+
+	var errImage error
+	if change.Old, errImage = decodeUserImage(record.Change.OldImage); errImage != nil {
+		return change, errImage
+	}
+	if change.New, errImage = decodeUserImage(record.Change.NewImage); errImage != nil {
+		return change, errImage
+	}
+
+	change.Changes = diffUsers(change.Old, change.New)
+	return change, nil
+}
+
+func decodeUserImage(image map[string]events.DynamoDBAttributeValue) (*UserInfoAdvanced, error) {
+
+	if len(image) == 0 {
+		return nil, nil
+	}
+
+	item, errConvert := streamImageToItem(image)
+	if errConvert != nil {
+		return nil, errConvert
+	}
+
+	var user UserInfoAdvanced
+	if errUnMarshal := dynamodbattribute.UnmarshalMap(item, &user); errUnMarshal != nil {
+		return nil, errors.New("ItemUnMarshalError" + "[" + errUnMarshal.Error() + "]")
+	}
+	return &user, nil
+}
+
+//streamImageToItem converts a stream image into the SDK attribute representation
+func streamImageToItem(image map[string]events.DynamoDBAttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+	item := make(map[string]*dynamodb.AttributeValue, len(image))
+	for name, value := range image {
+		converted, err := streamAttributeToSDK(value)
+		if err != nil {
+			return nil, err
+		}
+		item[name] = converted
+	}
+	return item, nil
+}
+
+func streamAttributeToSDK(value events.DynamoDBAttributeValue) (*dynamodb.AttributeValue, error) {
+
+	switch value.DataType() {
+	case events.DataTypeString:
+		return &dynamodb.AttributeValue{S: aws.String(value.String())}, nil
+	case events.DataTypeNumber:
+		return &dynamodb.AttributeValue{N: aws.String(value.Number())}, nil
+	case events.DataTypeBoolean:
+		return &dynamodb.AttributeValue{BOOL: aws.Bool(value.Boolean())}, nil
+	case events.DataTypeBinary:
+		return &dynamodb.AttributeValue{B: value.Binary()}, nil
+	case events.DataTypeNull:
+		return &dynamodb.AttributeValue{NULL: aws.Bool(true)}, nil
+	case events.DataTypeStringSet:
+		return &dynamodb.AttributeValue{SS: aws.StringSlice(value.StringSet())}, nil
+	case events.DataTypeNumberSet:
+		return &dynamodb.AttributeValue{NS: aws.StringSlice(value.NumberSet())}, nil
+	case events.DataTypeBinarySet:
+		return &dynamodb.AttributeValue{BS: value.BinarySet()}, nil
+	case events.DataTypeList:
+		list := make([]*dynamodb.AttributeValue, 0, len(value.List()))
+		for _, element := range value.List() {
+			converted, err := streamAttributeToSDK(element)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, converted)
+		}
+		return &dynamodb.AttributeValue{L: list}, nil
+	case events.DataTypeMap:
+		converted, err := streamImageToItem(value.Map())
+		if err != nil {
+			return nil, err
+		}
+		return &dynamodb.AttributeValue{M: converted}, nil
+	}
+
+	return nil, errors.New("UnsupportedAttributeType" + ": " + fmt.Sprint(value.DataType()))
+}
+
+//diffUsers compares the json tagged fields of both images
+func diffUsers(oldUser, newUser *UserInfoAdvanced) []FieldChange {
+
+	changes := []FieldChange{}
+	userType := reflect.TypeOf(UserInfoAdvanced{})
+
+	for i := 0; i < userType.NumField(); i++ {
+		field := userType.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			name = field.Name
+		}
+
+		var oldValue, newValue interface{}
+		if oldUser != nil {
+			oldValue = fieldValue(reflect.ValueOf(*oldUser).Field(i))
+		}
+		if newUser != nil {
+			newValue = fieldValue(reflect.ValueOf(*newUser).Field(i))
+		}
+		if !reflect.DeepEqual(oldValue, newValue) {
+			changes = append(changes, FieldChange{Field: name, Old: oldValue, New: newValue})
+		}
+	}
+	return changes
+}
+
+//fieldValue or nil for the zero value, matching omitempty attributes that are not stored
+func fieldValue(value reflect.Value) interface{} {
+	if value.IsZero() {
+		return nil
+	}
+	return value.Interface()
+}
+
+func toUserInfo(user *UserInfoAdvanced) *UserInfo {
+	if user == nil {
+		return nil
+	}
+	return &UserInfo{
+		UserId:    user.UserId,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+		CreatedBy: user.CreatedBy,
+		DeletedAt: user.DeletedAt,
+	}
+}
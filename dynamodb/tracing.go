@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"go.opentelemetry.io/contrib/propagators/aws/xray"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+//TracesExporterEnv selects where spans are exported: "otlp" sends them to the collector set by the
+//standard OTEL_EXPORTER_OTLP_* variables. Tracing is disabled when unset
+const TracesExporterEnv = "TRACES_EXPORTER"
+
+//lambdaTraceHeaderEnv holds the X-Ray trace header of the current invocation
+const lambdaTraceHeaderEnv = "_X_AMZN_TRACE_ID"
+
+const tracerName = "AWS-Lambda-GoLang"
+
+var (
+	tracingMu      sync.RWMutex
+	tracerProvider = newTracerProvider()
+	traceParent    trace.SpanContext
+)
+
+func newTracerProvider() trace.TracerProvider {
+	if os.Getenv(TracesExporterEnv) != "otlp" {
+		return noop.NewTracerProvider()
+	}
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		return noop.NewTracerProvider()
+	}
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithIDGenerator(xray.NewIDGenerator()))
+}
+
+//SetTracerProvider replaces the provider spans are created with
+func SetTracerProvider(provider trace.TracerProvider) {
+	tracingMu.Lock()
+	defer tracingMu.Unlock()
+	tracerProvider = provider
+}
+
+//NewInMemoryTracing records the spans in the returned exporter, for tests
+func NewInMemoryTracing() *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter), sdktrace.WithIDGenerator(xray.NewIDGenerator())))
+	return exporter
+}
+
+//FlushTraces exports the ended spans. Handlers defer it since Lambda freezes the process
+//between invocations
+func FlushTraces() error {
+	tracingMu.RLock()
+	defer tracingMu.RUnlock()
+	if flusher, ok := tracerProvider.(interface{ ForceFlush(context.Context) error }); ok {
+		return flusher.ForceFlush(context.Background())
+	}
+	return nil
+}
+
+//setTraceParent continues the trace of the invocation, from the trace header the Lambda
+//runtime puts in ctx or else the _X_AMZN_TRACE_ID environment variable
+func setTraceParent(ctx context.Context) {
+	header, _ := ctx.Value("x-amzn-trace-id").(string)
+	if header == "" {
+		header = os.Getenv(lambdaTraceHeaderEnv)
+	}
+	carrier := propagation.MapCarrier{"X-Amzn-Trace-Id": header}
+	parent := trace.SpanContextFromContext(xray.Propagator{}.Extract(context.Background(), carrier))
+
+	tracingMu.Lock()
+	defer tracingMu.Unlock()
+	traceParent = parent
+}
+
+//startSpan as a child of the span in ctx, or of the invocation when ctx has none
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracingMu.RLock()
+	provider, parent := tracerProvider, traceParent
+	tracingMu.RUnlock()
+
+	if !trace.SpanContextFromContext(ctx).IsValid() && parent.IsValid() {
+		ctx = trace.ContextWithRemoteSpanContext(ctx, parent)
+	}
+	return provider.Tracer(tracerName).Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attributes...))
+}
+
+//endSpan recording err
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+//traceSession creates a span around every request made by clients of the session and passes
+//the trace header on to AWS
+func traceSession(awsSession *session.Session) {
+	if awsSession == nil {
+		return
+	}
+	awsSession.Handlers.Validate.PushFrontNamed(request.NamedHandler{Name: "tracing.Start", Fn: startRequestSpan})
+	awsSession.Handlers.Complete.PushBackNamed(request.NamedHandler{Name: "tracing.End", Fn: endRequestSpan})
+}
+
+func startRequestSpan(r *request.Request) {
+	attributes := []attribute.KeyValue{
+		attribute.String("rpc.system", "aws-api"),
+		attribute.String("rpc.service", r.ClientInfo.ServiceName),
+		attribute.String("rpc.method", r.Operation.Name),
+		attribute.String("cloud.region", aws.StringValue(r.Config.Region)),
+	}
+	if params := reflect.Indirect(reflect.ValueOf(r.Params)); params.Kind() == reflect.Struct {
+		attributes = append(attributes, paramAttributes(params)...)
+	}
+
+	ctx, _ := startSpan(r.Context(), r.ClientInfo.ServiceName+"."+r.Operation.Name, attributes...)
+	r.SetContext(ctx)
+	xray.Propagator{}.Inject(ctx, propagation.HeaderCarrier(r.HTTPRequest.Header))
+}
+
+func endRequestSpan(r *request.Request) {
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttributes(
+		attribute.String("aws.request_id", r.RequestID),
+		attribute.Int("aws.retry_count", r.RetryCount),
+	)
+	if r.HTTPResponse != nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", r.HTTPResponse.StatusCode))
+	}
+	endSpan(span, r.Error)
+}
+
+//stringParam value of the *string field of the request parameters, empty when not set
+func stringParam(params reflect.Value, field string) string {
+	value := params.FieldByName(field)
+	if !value.IsValid() || value.Kind() != reflect.Ptr || value.IsNil() || value.Elem().Kind() != reflect.String {
+		return ""
+	}
+	return value.Elem().String()
+}
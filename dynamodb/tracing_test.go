@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const testTraceHeader = "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"
+
+//tracedClient of a DynamoDB stand-in answering with status and body, recording the trace header it got
+func tracedClient(t *testing.T, status int, body string, traceHeader *string) *dynamodb.DynamoDB {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*traceHeader = r.Header.Get("X-Amzn-Trace-Id")
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		w.Header().Set("X-Amzn-Requestid", "request-1")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	awsSession, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-2"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	traceSession(awsSession)
+	return dynamodb.New(awsSession)
+}
+
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTraceSessionRecordsRequestSpan(t *testing.T) {
+	exporter := NewInMemoryTracing()
+	defer SetTracerProvider(newTracerProvider())
+	setTraceParent(context.WithValue(context.Background(), "x-amzn-trace-id", testTraceHeader))
+	defer setTraceParent(context.Background())
+
+	var traceHeader string
+	client := tracedClient(t, http.StatusOK, `{"Item":{"userId":{"S":"user-1"}}}`, &traceHeader)
+	_, err := client.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String("users"),
+		Key:       map[string]*dynamodb.AttributeValue{"userId": {S: aws.String("user-1")}},
+	})
+	if err != nil {
+		t.Fatalf("GetItem: %v", err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("spans = %d, want 1", len(spans))
+	}
+	span := spans[0]
+	if span.Name != "dynamodb.GetItem" {
+		t.Errorf("name = %q", span.Name)
+	}
+	if tables := spanAttribute(span, "aws.dynamodb.table_names").AsStringSlice(); len(tables) != 1 || tables[0] != "users" {
+		t.Errorf("tables = %v", tables)
+	}
+	if key := spanAttribute(span, "aws.dynamodb.key").AsString(); key != "userId=user-1" {
+		t.Errorf("key = %q", key)
+	}
+	if status := spanAttribute(span, "http.response.status_code").AsInt64(); status != http.StatusOK {
+		t.Errorf("status = %d", status)
+	}
+	if requestID := spanAttribute(span, "aws.request_id").AsString(); requestID != "request-1" {
+		t.Errorf("request ID = %q", requestID)
+	}
+
+	// The span continues the invocation trace and its context reaches the service
+	if traceID := span.SpanContext.TraceID().String(); traceID != "5759e988bd862e3fe1be46a994272793" {
+		t.Errorf("trace ID = %s", traceID)
+	}
+	if span.Parent.SpanID().String() != "53995c3f42cd8ad8" {
+		t.Errorf("parent = %s", span.Parent.SpanID())
+	}
+	if !strings.Contains(traceHeader, "Parent="+span.SpanContext.SpanID().String()) {
+		t.Errorf("trace header = %q, want the span as parent", traceHeader)
+	}
+}
+
+func TestTraceSessionRecordsErrors(t *testing.T) {
+	exporter := NewInMemoryTracing()
+	defer SetTracerProvider(newTracerProvider())
+
+	var traceHeader string
+	client := tracedClient(t, http.StatusBadRequest, `{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException","message":"The conditional request failed"}`, &traceHeader)
+	_, err := client.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String("users"),
+		Key:       map[string]*dynamodb.AttributeValue{"userId": {S: aws.String("user-1")}},
+	})
+	if err == nil {
+		t.Fatal("DeleteItem succeeded, want ConditionalCheckFailedException")
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Status.Code != codes.Error || len(spans[0].Events) == 0 {
+		t.Fatalf("spans = %+v, want one span with an error status and event", spans)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+)
+
+//ttlAttribute the table's TTL is enabled on, holding epoch seconds. DynamoDB deletes items
+//some time after it passes, reads skip them meanwhile
+const ttlAttribute = "expiresAt"
+
+//TTLAfter returns the expiresAt value of a user expiring after ttl, e.g. for trial users
+//written through the ingest or import paths
+func TTLAfter(ttl time.Duration) int64 {
+	return time.Now().Add(ttl).Unix()
+}
+
+//SetUserTTL makes the user expire at expiresAt
+func SetUserTTL(userID, tableName string, expiresAt time.Time) error {
+	update := expression.Set(expression.Name(ttlAttribute), expression.Value(expiresAt.Unix()))
+	return updateUserTTL("SetUserTTL", userID, tableName, update, expression.AttributeExists(expression.Name("userId")),
+		func(map[string]*dynamodb.AttributeValue) int64 { return expiresAt.Unix() })
+}
+
+//ExtendUserTTL moves the expiry of a user that has not expired yet by extension
+func ExtendUserTTL(userID, tableName string, extension time.Duration) error {
+	update := expression.Set(expression.Name(ttlAttribute),
+		expression.Name(ttlAttribute).Plus(expression.Value(int64(extension/time.Second))))
+	return updateUserTTL("ExtendUserTTL", userID, tableName, update, expression.Name(ttlAttribute).GreaterThan(expression.Value(time.Now().Unix())),
+		func(before map[string]*dynamodb.AttributeValue) int64 {
+			return itemExpiresAt(before) + int64(extension/time.Second)
+		})
+}
+
+//ClearUserTTL so the user no longer expires
+func ClearUserTTL(userID, tableName string) error {
+	update := expression.Remove(expression.Name(ttlAttribute))
+	return updateUserTTL("ClearUserTTL", userID, tableName, update, expression.AttributeExists(expression.Name("userId")),
+		func(map[string]*dynamodb.AttributeValue) int64 { return 0 })
+}
+
+//updateUserTTL applies the update of expiresAt. expiresAfter gives the value it has after the
+//update from the item before, zero when removed, for the after image of the audit entry
+func updateUserTTL(operation, userID, tableName string, update expression.UpdateBuilder, condition expression.ConditionBuilder,
+	expiresAfter func(before map[string]*dynamodb.AttributeValue) int64) error {
+	start := time.Now()
+	opLogger := logger().With("operation", operation, "table", tableName, "userId", userID)
+
+	if errValidate := ValidateField("userId", userID, userIDRules); errValidate != nil {
+		opLogger.Warn("ValidationError", "error", errValidate.Error(), "durationMs", sinceMs(start))
+		return errValidate
+	}
+
+	region := "us-east-2"
+	awsSession, _ := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
+
+	dynaClient := dynamodb.New(awsSession)
+
+	now := auditTimestamp()
+	update = update.Set(expression.Name("updatedAt"), expression.Value(now))
+	expr, errExpression := expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(condition.And(notDeleted())).
+		Build()
+	if errExpression != nil {
+		opLogger.Error("Update Expression Error", "error", errExpression.Error(), "durationMs", sinceMs(start))
+		return errExpression
+	}
+
+	keys := make(map[string]*dynamodb.AttributeValue)
+	itemKeyValue := dynamodb.AttributeValue{S: aws.String(userID)}
+	keys["userId"] = &itemKeyValue
+
+	input := &dynamodb.UpdateItemInput{
+		Key:                       keys,
+		TableName:                 aws.String(tableName),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnConsumedCapacity:    aws.String(dynamodb.ReturnConsumedCapacityTotal),
+	}
+
+	// With an audit table the update and its audit entry are written in one transaction
+	updateOutput := &dynamodb.UpdateItemOutput{}
+	var errUpdateItem error
+	if currentAuditTable() != "" {
+		_, updateOutput.ConsumedCapacity, errUpdateItem = writeAudited(dynaClient, operation, tableName, userID, transactUpdate(input),
+			func(before map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+				if expiresAt := expiresAfter(before); expiresAt > 0 {
+					return auditImage(before, map[string]interface{}{ttlAttribute: expiresAt, "updatedAt": now})
+				}
+				return auditImage(before, map[string]interface{}{"updatedAt": now}, ttlAttribute)
+			})
+	} else {
+		updateOutput, errUpdateItem = dynaClient.UpdateItem(input)
+	}
+	recordCall(operation, tableName, start, errUpdateItem)
+	if errUpdateItem != nil {
+		if _, open := errUpdateItem.(*CircuitOpenError); open {
+			opLogger.Warn("CircuitOpen", "error", errUpdateItem.Error(), "durationMs", sinceMs(start))
+			return errUpdateItem
+		}
+		if awsErr, ok := errUpdateItem.(awserr.Error); ok && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			opLogger.Warn("UserNotFound", "durationMs", sinceMs(start))
+			return errors.New("UserNotFound" + ": " + userID)
+		}
+		errorString := "UpdateItemError" + "[" + errUpdateItem.Error() + "]"
+		opLogger.Error("UpdateItemError", "error", errUpdateItem.Error(), "durationMs", sinceMs(start))
+		return errors.New(errorString)
+	}
+	recordCapacity(operation, tableName, updateOutput.ConsumedCapacity)
+	opLogger.Info("User TTL Updated Successfully", "durationMs", sinceMs(start))
+	return nil
+}
+
+//notExpired filter condition of reads
+func notExpired() expression.ConditionBuilder {
+	return expression.Or(
+		expression.AttributeNotExists(expression.Name(ttlAttribute)),
+		expression.Name(ttlAttribute).GreaterThan(expression.Value(time.Now().Unix())),
+	)
+}
+
+//isExpired reports an expiresAt value that has passed, zero never expires
+func isExpired(expiresAt int64) bool {
+	return expiresAt > 0 && expiresAt <= time.Now().Unix()
+}
+
+//itemExpired reports an item whose TTL has passed
+func itemExpired(item map[string]*dynamodb.AttributeValue) bool {
+	return isExpired(itemExpiresAt(item))
+}
+
+//itemExpiresAt value of an item, zero when not set
+func itemExpiresAt(item map[string]*dynamodb.AttributeValue) int64 {
+	value, ok := item[ttlAttribute]
+	if !ok || value == nil || value.N == nil {
+		return 0
+	}
+	expiresAt, _ := strconv.ParseInt(*value.N, 10, 64)
+	return expiresAt
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+//Rules of user keys and queries, written like a "validate" tag
+const (
+	userIDRules  = "required,max=128,format=id"
+	groupRules   = "required,max=64,format=id"
+	batchRules   = "required,max=64,format=id"
+	storeIDRules = "required,max=64,format=id"
+	activeRules  = "oneof=true|false|any"
+)
+
+//maxBatchGetKeys of a single BatchGetItem call
+const maxBatchGetKeys = 100
+
+//Validation rules of the "validate" struct tag, comma separated:
+//
+//	required      the value must not be empty
+//	min=N, max=N  length in characters
+//	format=id     letters, digits, "_", "-", "." and ":", starting with a letter or digit
+//	chars=name    letters, spaces, "'", "-" and "."
+//	oneof=a|b     one of the listed values
+//
+//Rules other than required accept the empty value
+var (
+	formats = map[string]*regexp.Regexp{
+		"id": regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:-]*$`),
+	}
+	charsets = map[string]*regexp.Regexp{
+		"name": regexp.MustCompile(`^[\p{L}\p{M} .'-]*$`),
+	}
+)
+
+//FieldError of a single rule a field failed
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+//ValidationError lists every rule the input failed
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Fields))
+	for _, field := range e.Fields {
+		messages = append(messages, field.Field+" "+field.Message)
+	}
+	return "ValidationError" + "[" + strings.Join(messages, "; ") + "]"
+}
+
+//Validate the string fields of the struct against their "validate" tags, returning a
+//*ValidationError when any fails
+func Validate(v interface{}) error {
+
+	value := reflect.Indirect(reflect.ValueOf(v))
+	if value.Kind() != reflect.Struct {
+		return errors.New("InvalidValidationTarget" + ": " + "expected struct, got " + value.Kind().String())
+	}
+
+	var fieldErrors []FieldError
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		rules, ok := field.Tag.Lookup("validate")
+		if !ok || field.Type.Kind() != reflect.String {
+			continue
+		}
+		fieldErrors = append(fieldErrors, checkField(jsonName(field), value.Field(i).String(), rules)...)
+	}
+
+	if len(fieldErrors) > 0 {
+		return &ValidationError{Fields: fieldErrors}
+	}
+	return nil
+}
+
+//ValidateField value against rules written like a "validate" tag
+func ValidateField(name, value, rules string) error {
+	if fieldErrors := checkField(name, value, rules); len(fieldErrors) > 0 {
+		return &ValidationError{Fields: fieldErrors}
+	}
+	return nil
+}
+
+//validateList of values against the rules, with between 1 and maxItems of them
+func validateList(name string, values []string, rules string, maxItems int) error {
+
+	var fieldErrors []FieldError
+	if len(values) == 0 {
+		fieldErrors = append(fieldErrors, FieldError{Field: name, Rule: "required", Message: "is required"})
+	}
+	if len(values) > maxItems {
+		fieldErrors = append(fieldErrors, FieldError{Field: name, Rule: "max", Message: "must have at most " + strconv.Itoa(maxItems) + " items"})
+	}
+	for i, value := range values {
+		fieldErrors = append(fieldErrors, checkField(name+"["+strconv.Itoa(i)+"]", value, rules)...)
+	}
+
+	if len(fieldErrors) > 0 {
+		return &ValidationError{Fields: fieldErrors}
+	}
+	return nil
+}
+
+func checkField(name, value, rules string) []FieldError {
+
+	var fieldErrors []FieldError
+	for _, rule := range strings.Split(rules, ",") {
+		ruleName, argument := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			ruleName, argument = rule[:i], rule[i+1:]
+		}
+		if value == "" && ruleName != "required" {
+			continue
+		}
+		if message := checkRule(ruleName, argument, value); message != "" {
+			fieldErrors = append(fieldErrors, FieldError{Field: name, Rule: ruleName, Message: message})
+		}
+	}
+	return fieldErrors
+}
+
+//checkRule returns the message of a failed rule, empty when value passes
+func checkRule(rule, argument, value string) string {
+
+	switch rule {
+	case "required":
+		if value == "" {
+			return "is required"
+		}
+	case "min":
+		if limit, _ := strconv.Atoi(argument); utf8.RuneCountInString(value) < limit {
+			return "must be at least " + argument + " characters"
+		}
+	case "max":
+		if limit, _ := strconv.Atoi(argument); utf8.RuneCountInString(value) > limit {
+			return "must be at most " + argument + " characters"
+		}
+	case "format":
+		pattern, ok := formats[argument]
+		if !ok {
+			return "has unknown format " + argument
+		}
+		if !pattern.MatchString(value) {
+			return "must be a valid " + argument
+		}
+	case "chars":
+		pattern, ok := charsets[argument]
+		if !ok {
+			return "has unknown character set " + argument
+		}
+		if !pattern.MatchString(value) {
+			return "contains characters not allowed in a " + argument
+		}
+	case "oneof":
+		options := strings.Split(argument, "|")
+		for _, option := range options {
+			if value == option {
+				return ""
+			}
+		}
+		return "must be one of " + strings.Join(options, ", ")
+	default:
+		return "has unknown rule " + rule
+	}
+	return ""
+}
+
+//jsonName of the field, as the API reports it
+func jsonName(field reflect.StructField) string {
+	if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+		return name
+	}
+	return field.Name
+}
@@ -0,0 +1,29 @@
+package main
+
+import "time"
+
+//bucketDimensions of a metric for an operation on a bucket
+func bucketDimensions(operation, bucketName string) map[string]string {
+	return map[string]string{"Operation": operation, "Bucket": bucketName}
+}
+
+//recordCall emits the latency of an S3 call, and its error type and throttling on failure
+func recordCall(operation, bucketName string, start time.Time, err error) {
+	putMetric("Latency", float64(sinceMs(start)), UnitMilliseconds, bucketDimensions(operation, bucketName))
+	if err == nil {
+		return
+	}
+
+	errorDimensions := bucketDimensions(operation, bucketName)
+	errorDimensions["ErrorType"] = errorType(err)
+	putMetric("Errors", 1, UnitCount, errorDimensions)
+	if isThrottle(err) {
+		putMetric("Throttles", 1, UnitCount, bucketDimensions(operation, bucketName))
+	}
+}
+
+//recordObject emits the count and size of an object written
+func recordObject(operation, bucketName string, size int) {
+	putMetric("ObjectCount", 1, UnitCount, bucketDimensions(operation, bucketName))
+	putMetric("ObjectBytes", float64(size), UnitBytes, bucketDimensions(operation, bucketName))
+}
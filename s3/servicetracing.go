@@ -0,0 +1,20 @@
+package main
+
+import (
+	"reflect"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+//paramAttributes of the bucket and object key a request is made for
+func paramAttributes(params reflect.Value) []attribute.KeyValue {
+
+	var attributes []attribute.KeyValue
+	if bucket := stringParam(params, "Bucket"); bucket != "" {
+		attributes = append(attributes, attribute.String("aws.s3.bucket", bucket))
+	}
+	if objectKey := stringParam(params, "Key"); objectKey != "" {
+		attributes = append(attributes, attribute.String("aws.s3.key", objectKey))
+	}
+	return attributes
+}
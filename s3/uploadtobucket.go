@@ -1,8 +1,8 @@
 package main
 
 import (
-	"fmt"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -11,6 +11,8 @@ import (
 
 func main() {
 	UploadtoS3()
+	FlushMetrics()
+	FlushTraces()
 }
 
 //UploadtoS3 bucket
@@ -19,12 +21,18 @@ func UploadtoS3() {
 	bucketName := ""
 	objectKey := ""
 
+	start := time.Now()
+	opLogger := logger().With("operation", "UploadtoS3", "bucket", bucketName, "key", objectKey)
+
 	payload := ""
 
 	region := "us-east-2"
 	awsSession, _ := session.NewSession(&aws.Config{
 		Region: aws.String(region)},
 	)
+	traceSession(awsSession)
+	retrySession(awsSession)
+	breakSession(awsSession)
 
 	svc := s3.New(awsSession)
 
@@ -35,8 +43,11 @@ func UploadtoS3() {
 	}
 
 	_, err := svc.PutObject(s3BucketInput)
+	recordCall("UploadtoS3", bucketName, start, err)
 	if err != nil {
-		errorString := "Error while Uploading to S3 Bucket" + "[" + err.Error() + "]"
-		fmt.Println(errorString)
+		opLogger.Error("Error while Uploading to S3 Bucket", "error", err.Error(), "durationMs", sinceMs(start))
+		return
 	}
+	recordObject("UploadtoS3", bucketName, len(payload))
+	opLogger.Info("Uploaded to S3 Bucket Successfully", "durationMs", sinceMs(start))
 }
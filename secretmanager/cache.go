@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+//CacheTTLEnv sets how long fetched secrets and parameters are reused, e.g. "5m".
+//Caching is disabled when it is unset
+const CacheTTLEnv = "CONFIG_CACHE_TTL"
+
+//valueCache keeps fetched values for the lifetime of the Lambda container
+type valueCache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	values  map[string]string
+	expires time.Time
+}
+
+var configCache = &valueCache{entries: make(map[string]cacheEntry)}
+
+//cacheTTL read from the environment, zero when caching is disabled
+func cacheTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv(CacheTTLEnv))
+	if err != nil || ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
+//getOrFetch returns the cached values for key or calls fetch and caches its result
+func (c *valueCache) getOrFetch(key string, fetch func() (map[string]string, error)) (map[string]string, error) {
+
+	ttl := cacheTTL()
+	if ttl == 0 {
+		return fetch()
+	}
+
+	c.mu.Lock()
+	entry, found := c.entries[key]
+	c.mu.Unlock()
+	if found && time.Now().Before(entry.expires) {
+		return copyValues(entry.values), nil
+	}
+
+	values, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.entries[key] = cacheEntry{values: copyValues(values), expires: time.Now().Add(ttl)}
+	c.mu.Unlock()
+
+	return values, nil
+}
+
+//InvalidateCache forces the next lookups to fetch fresh values, e.g. after a credential is rejected
+func InvalidateCache() {
+	configCache.invalidate()
+}
+
+//invalidate drops every cached entry
+func (c *valueCache) invalidate() {
+	c.mu.Lock()
+	c.entries = make(map[string]cacheEntry)
+	c.mu.Unlock()
+}
+
+func copyValues(values map[string]string) map[string]string {
+	copied := make(map[string]string, len(values))
+	for k, v := range values {
+		copied[k] = v
+	}
+	return copied
+}
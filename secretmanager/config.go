@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//MissingConfigError lists every config value that could not be resolved
+type MissingConfigError struct {
+
+	// Secret references (secretId#key) and environment variable names
+	Missing []string
+
+	// Values that could not be read or parsed, as "reference: reason"
+	Invalid []string
+}
+
+func (e *MissingConfigError) Error() string {
+	return "MissingConfigError" + "[" + strings.Join(append(append([]string{}, e.Missing...), e.Invalid...), ", ") + "]"
+}
+
+//LoadConfig populates the struct pointed to by target from its field tags:
+//
+//	DBPassword string `secret:"db-creds#password"`
+//	TableName  string `env:"TABLE_NAME"`
+//
+//Each secret is fetched once through GetSecrets. Missing values, failed secrets and unparsable
+//values are reported together in a *MissingConfigError. Call it at cold start, e.g. from init(),
+//so a Lambda with missing configuration fails before serving any request
+func LoadConfig(target interface{}) error {
+	return loadConfig(target, GetSecrets, os.LookupEnv)
+}
+
+//LoadConfigFrom populates target like LoadConfig, resolving the "name#key" references
+//of secret tags through source, e.g. ParameterStoreSource{} with `secret:"/app/db#password"`
+func LoadConfigFrom(source ConfigSource, target interface{}) error {
+	return loadConfig(target, source.GetValues, os.LookupEnv)
+}
+
+//loadConfig with the secret and environment lookups supplied by the caller
+func loadConfig(target interface{}, getSecrets func(string) (map[string]string, error), lookupEnv func(string) (string, bool)) error {
+
+	value := reflect.ValueOf(target)
+	if !value.IsValid() || value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+		typeName := "nil"
+		if value.IsValid() {
+			typeName = value.Type().String()
+		}
+		errorString := "InvalidConfigTarget" + ": " + "expected pointer to struct, got " + typeName
+		logger().Error("InvalidConfigTarget", "operation", "LoadConfig", "type", typeName)
+		return errors.New(errorString)
+	}
+
+	loader := configLoader{
+		getSecrets: getSecrets,
+		lookupEnv:  lookupEnv,
+		secrets:    make(map[string]map[string]string),
+		failed:     make(map[string]error),
+	}
+	loader.load(value.Elem())
+
+	if len(loader.missing) > 0 || len(loader.invalid) > 0 {
+		err := &MissingConfigError{Missing: loader.missing, Invalid: loader.invalid}
+		logger().Error("MissingConfigError", "operation", "LoadConfig", "missing", loader.missing, "invalid", loader.invalid)
+		return err
+	}
+	return nil
+}
+
+type configLoader struct {
+	getSecrets func(string) (map[string]string, error)
+	lookupEnv  func(string) (string, bool)
+
+	// Secrets already fetched during this load, by secret ID
+	secrets map[string]map[string]string
+
+	// Secrets that failed to fetch, by secret ID, so they are fetched once
+	failed map[string]error
+
+	missing []string
+	invalid []string
+}
+
+//load every tagged field, collecting the missing and invalid ones
+func (l *configLoader) load(value reflect.Value) {
+
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		fieldValue := value.Field(i)
+		if !fieldValue.CanSet() {
+			continue
+		}
+
+		secretTag, hasSecret := field.Tag.Lookup("secret")
+		envTag, hasEnv := field.Tag.Lookup("env")
+
+		if !hasSecret && !hasEnv {
+			if fieldValue.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Time{}) {
+				l.load(fieldValue)
+			}
+			continue
+		}
+
+		var raw string
+		var found bool
+		var reference string
+		if hasSecret {
+			reference = secretTag
+			var errSecret error
+			raw, found, errSecret = l.secretValue(secretTag)
+			if errSecret != nil {
+				l.invalid = append(l.invalid, reference+": "+errSecret.Error())
+				continue
+			}
+		} else {
+			reference = envTag
+			raw, found = l.lookupEnv(envTag)
+		}
+
+		if !found {
+			l.missing = append(l.missing, reference)
+			continue
+		}
+
+		if errSet := setConfigField(fieldValue, raw); errSet != nil {
+			logger().Error("InvalidConfigValue", "operation", "LoadConfig", "reference", reference, "error", errSet.Error())
+			l.invalid = append(l.invalid, reference+": "+errSet.Error())
+		}
+	}
+}
+
+//secretValue resolves a "secretId#key" reference
+func (l *configLoader) secretValue(reference string) (string, bool, error) {
+
+	separator := strings.LastIndex(reference, "#")
+	if separator <= 0 || separator == len(reference)-1 {
+		errorString := "InvalidSecretReference" + ": " + reference
+		logger().Error("InvalidSecretReference", "operation", "LoadConfig", "reference", reference)
+		return "", false, errors.New(errorString)
+	}
+	secretID, key := reference[:separator], reference[separator+1:]
+
+	if errSecrets, failed := l.failed[secretID]; failed {
+		return "", false, errSecrets
+	}
+	secrets, fetched := l.secrets[secretID]
+	if !fetched {
+		var errSecrets error
+		secrets, errSecrets = l.getSecrets(secretID)
+		if errSecrets != nil {
+			l.failed[secretID] = errSecrets
+			return "", false, errSecrets
+		}
+		l.secrets[secretID] = secrets
+	}
+
+	value, found := secrets[key]
+	return value, found, nil
+}
+
+func setConfigField(field reflect.Value, raw string) error {
+
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		duration, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(duration))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(parsed)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(raw, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(parsed)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseUint(raw, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(parsed)
+	case reflect.Float32, reflect.Float64:
+		parsed, err := strconv.ParseFloat(raw, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(parsed)
+	default:
+		return errors.New("unsupported field type " + field.Type().String())
+	}
+	return nil
+}
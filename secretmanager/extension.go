@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+//SecretsModeEnv selects how GetSecrets reads secrets: "sdk" (default) or "extension"
+//to read through the AWS Parameters and Secrets Lambda Extension, falling back to the
+//SDK when the extension is not running
+const SecretsModeEnv = "SECRETS_MODE"
+
+//SecretsModeExtension reads secrets through the Lambda extension
+const SecretsModeExtension = "extension"
+
+//Environment used to reach the extension
+const (
+	extensionPortEnv     = "PARAMETERS_SECRETS_EXTENSION_HTTP_PORT"
+	extensionEndpointEnv = "PARAMETERS_SECRETS_EXTENSION_ENDPOINT"
+	extensionTokenHeader = "X-Aws-Parameters-Secrets-Token"
+)
+
+//errExtensionUnavailable when the extension endpoint cannot be reached
+var errExtensionUnavailable = errors.New("ExtensionUnavailable")
+
+//extensionClient for the local HTTP endpoint of the Parameters and Secrets extension
+type extensionClient struct {
+
+	// Base URL such as http://localhost:2773
+	endpoint string
+
+	// Value of the X-Aws-Parameters-Secrets-Token header, the Lambda session token
+	token string
+
+	httpClient *http.Client
+}
+
+//extensionFromEnv builds the client when SECRETS_MODE selects the extension, nil otherwise
+func extensionFromEnv() *extensionClient {
+
+	if os.Getenv(SecretsModeEnv) != SecretsModeExtension {
+		return nil
+	}
+
+	endpoint := os.Getenv(extensionEndpointEnv)
+	if endpoint == "" {
+		port := os.Getenv(extensionPortEnv)
+		if port == "" {
+			port = "2773"
+		}
+		endpoint = "http://localhost:" + port
+	}
+
+	return &extensionClient{
+		endpoint:   endpoint,
+		token:      os.Getenv("AWS_SESSION_TOKEN"),
+		httpClient: &http.Client{Timeout: 2 * time.Second},
+	}
+}
+
+//getSecrets fetches and decodes the secret from the extension
+func (c *extensionClient) getSecrets(secretKey string, version SecretVersion) (map[string]string, error) {
+
+	start := time.Now()
+	opLogger := logger().With("operation", "GetSecrets", "source", "extension", "secretId", secretKey)
+
+	result := make(map[string]string)
+
+	query := url.Values{}
+	query.Set("secretId", secretKey)
+	if version.VersionId != "" {
+		query.Set("versionId", version.VersionId)
+	}
+	if version.VersionStage != "" {
+		query.Set("versionStage", version.VersionStage)
+	}
+
+	request, errRequest := http.NewRequest(http.MethodGet, c.endpoint+"/secretsmanager/get?"+query.Encode(), nil)
+	if errRequest != nil {
+		opLogger.Error("ExtensionRequestError", "error", errRequest.Error())
+		return nil, errRequest
+	}
+	request.Header.Set(extensionTokenHeader, c.token)
+
+	response, errFromExtension := c.httpClient.Do(request)
+	recordCall("GetSecrets", "SecretId", secretKey, start, errFromExtension)
+	if errFromExtension != nil {
+		err := fmt.Errorf("%w[%s]", errExtensionUnavailable, errFromExtension.Error())
+		opLogger.Warn("ExtensionUnavailable", "error", errFromExtension.Error(), "durationMs", sinceMs(start))
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, errRead := ioutil.ReadAll(response.Body)
+	if errRead != nil {
+		opLogger.Error("ExtensionReadError", "error", errRead.Error(), "durationMs", sinceMs(start))
+		return nil, errRead
+	}
+	if response.StatusCode != http.StatusOK {
+		errFromService := extensionError(response.StatusCode, body)
+		opLogger.Error("ExtensionSecretLookupError", "status", response.Status, "code", errFromService.Code(), "response", string(body), "durationMs", sinceMs(start))
+		return nil, errFromService
+	}
+
+	var output struct {
+		SecretString *string `json:"SecretString"`
+	}
+	if errFromUnmarshal := json.Unmarshal(body, &output); errFromUnmarshal != nil {
+		opLogger.Error("ExtensionResponseUnMarshalError", "error", errFromUnmarshal.Error(), "durationMs", sinceMs(start))
+		return nil, errFromUnmarshal
+	}
+	if output.SecretString == nil {
+		errorString := "Unable to find the secrets from the secret manager for the key: " + secretKey
+		opLogger.Error("SecretStringNotFound", "durationMs", sinceMs(start))
+		return nil, errors.New(errorString)
+	}
+
+	errFromUnmarshal := json.Unmarshal([]byte(*output.SecretString), &result)
+	if errFromUnmarshal != nil {
+		opLogger.Error("SecretUnMarshalError", "error", errFromUnmarshal.Error(), "durationMs", sinceMs(start))
+		return nil, errFromUnmarshal
+	}
+
+	opLogger.Debug("Secret Fetched Successfully", "durationMs", sinceMs(start))
+	return result, nil
+}
+
+//extensionErrorCode at the start of a plain text error, e.g. "ResourceNotFoundException: ..."
+var extensionErrorCode = regexp.MustCompile(`^([A-Za-z]+(?:Exception|Error))\s*:?\s*`)
+
+//extensionError of a failed extension response as the service error the SDK would return, so
+//callers can match the code, e.g. ResourceNotFoundException for a missing AWSPREVIOUS version.
+//The extension forwards the JSON error of Secrets Manager, whose keys match in any case, or a
+//"Code: message" text
+func extensionError(statusCode int, body []byte) awserr.RequestFailure {
+
+	var output struct {
+		Type    string `json:"__type"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	code, message := "", strings.TrimSpace(string(body))
+	if json.Unmarshal(body, &output) == nil {
+		code = output.Type
+		if code == "" {
+			code = output.Code
+		}
+		if i := strings.LastIndex(code, "#"); i >= 0 {
+			code = code[i+1:]
+		}
+		if output.Message != "" {
+			message = output.Message
+		}
+	} else if match := extensionErrorCode.FindStringSubmatch(message); match != nil {
+		code, message = match[1], message[len(match[0]):]
+	}
+
+	if code == "" {
+		switch statusCode {
+		case http.StatusNotFound:
+			code = secretsmanager.ErrCodeResourceNotFoundException
+		case http.StatusBadRequest:
+			code = secretsmanager.ErrCodeInvalidRequestException
+		default:
+			code = "ExtensionSecretLookupError"
+		}
+	}
+	return awserr.NewRequestFailure(awserr.New(code, message, nil), statusCode, "")
+}
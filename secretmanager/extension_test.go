@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+)
+
+//extensionServer stands in for the Parameters and Secrets extension. It serves AWSCURRENT and
+//answers AWSPREVIOUS with the error of a secret that was never rotated
+func extensionServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/secretsmanager/get" || r.Header.Get(extensionTokenHeader) != "token" {
+			t.Errorf("unexpected request %s with token %q", r.URL, r.Header.Get(extensionTokenHeader))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Query().Get("versionStage") {
+		case VersionStageCurrent:
+			w.Write([]byte(`{"Name":"db","SecretString":"{\"password\":\"current\"}"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"__type":"ResourceNotFoundException","message":"Secrets Manager can't find the specified secret value for staging label: AWSPREVIOUS"}`))
+		}
+	}))
+}
+
+func useExtension(t *testing.T, endpoint string) {
+	t.Setenv(SecretsModeEnv, SecretsModeExtension)
+	t.Setenv(extensionEndpointEnv, endpoint)
+	t.Setenv("AWS_SESSION_TOKEN", "token")
+	t.Setenv(CacheTTLEnv, "")
+}
+
+func TestGetSecretsThroughExtension(t *testing.T) {
+	server := extensionServer(t)
+	defer server.Close()
+	useExtension(t, server.URL)
+
+	secrets, err := GetSecrets("db")
+	if err != nil {
+		t.Fatalf("GetSecrets: %v", err)
+	}
+	if secrets["password"] != "current" {
+		t.Errorf("password = %q, want current", secrets["password"])
+	}
+}
+
+func TestExtensionNotFoundIsServiceError(t *testing.T) {
+	server := extensionServer(t)
+	defer server.Close()
+	useExtension(t, server.URL)
+
+	_, err := GetSecretsVersion("db", SecretVersion{VersionStage: VersionStagePrevious})
+	awsErr, ok := err.(awserr.Error)
+	if !ok || awsErr.Code() != secretsmanager.ErrCodeResourceNotFoundException {
+		t.Fatalf("err = %v, want %s", err, secretsmanager.ErrCodeResourceNotFoundException)
+	}
+
+	current, previous, err := GetCurrentAndPreviousSecrets("db")
+	if err != nil {
+		t.Fatalf("GetCurrentAndPreviousSecrets: %v", err)
+	}
+	if current["password"] != "current" || previous != nil {
+		t.Errorf("current = %v, previous = %v, want the current secret and no previous", current, previous)
+	}
+}
+
+func TestExtensionErrorText(t *testing.T) {
+	err := extensionError(http.StatusBadRequest, []byte("ResourceNotFoundException: no such version"))
+	if err.Code() != secretsmanager.ErrCodeResourceNotFoundException || err.Message() != "no such version" {
+		t.Errorf("code = %q, message = %q", err.Code(), err.Message())
+	}
+	if err := extensionError(http.StatusNotFound, []byte("not found")); err.Code() != secretsmanager.ErrCodeResourceNotFoundException {
+		t.Errorf("code of a bare 404 = %q", err.Code())
+	}
+}
+
+//fakeSecretsManager answers GetSecretValue like the SDK client
+type fakeSecretsManager struct {
+	secretsmanageriface.SecretsManagerAPI
+	calls int
+}
+
+func (f *fakeSecretsManager) GetSecretValueWithContext(ctx aws.Context, input *secretsmanager.GetSecretValueInput, options ...request.Option) (*secretsmanager.GetSecretValueOutput, error) {
+	f.calls++
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(`{"password":"sdk"}`)}, nil
+}
+
+func TestExtensionUnavailableFallsBack(t *testing.T) {
+	server := extensionServer(t)
+	endpoint := server.URL
+	server.Close()
+	useExtension(t, endpoint)
+
+	// GetSecretsVersion falls back to the SDK on errExtensionUnavailable only
+	_, err := extensionFromEnv().getSecrets("db", SecretVersion{VersionStage: VersionStageCurrent})
+	if !errors.Is(err, errExtensionUnavailable) {
+		t.Fatalf("err = %v, want errExtensionUnavailable", err)
+	}
+
+	svc := &fakeSecretsManager{}
+	secrets, err := getSecretsFromSvc(aws.BackgroundContext(), svc, "db", SecretVersion{VersionStage: VersionStageCurrent})
+	if err != nil || secrets["password"] != "sdk" || svc.calls != 1 {
+		t.Errorf("secrets = %v, err = %v, calls = %d", secrets, err, svc.calls)
+	}
+}
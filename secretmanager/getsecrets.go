@@ -1,50 +1,135 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+//Version stages maintained by Secrets Manager during rotation
+const (
+	VersionStageCurrent  = "AWSCURRENT"
+	VersionStagePending  = "AWSPENDING"
+	VersionStagePrevious = "AWSPREVIOUS"
 )
 
 func main() {
-	fmt.Println(GetSecrets("secretkey"))
+	secrets, err := GetSecrets("secretkey")
+	logger().Info("GetSecrets", "keys", len(secrets), "error", err)
+	FlushMetrics()
+	FlushTraces()
+}
+
+//SecretVersion selects the version of the secret to be fetched
+type SecretVersion struct {
+
+	// Staging label such as AWSCURRENT, AWSPENDING or AWSPREVIOUS
+	VersionStage string
+
+	// Exact version of the secret, when set together with VersionStage both must match
+	VersionId string
 }
 
 //GetSecrets for the secret key
 func GetSecrets(secretKey string) (map[string]string, error) {
+	return GetSecretsVersion(secretKey, SecretVersion{VersionStage: VersionStageCurrent})
+}
 
-	result := make(map[string]string)
+//GetSecretsVersion for the secret key at the given version stage or version ID.
+//Results are cached when CONFIG_CACHE_TTL is set, and read through the Lambda
+//extension when SECRETS_MODE is "extension"
+func GetSecretsVersion(secretKey string, version SecretVersion) (map[string]string, error) {
+
+	cacheKey := "secretsmanager:" + secretKey + "#" + version.VersionStage + "#" + version.VersionId
+	return configCache.getOrFetch(cacheKey, func() (map[string]string, error) {
+
+		if extension := extensionFromEnv(); extension != nil {
+			_, span := startSpan(context.Background(), "SecretsManagerExtension.GetSecretValue", attribute.String("aws.secretsmanager.secret_id", secretKey))
+			result, errFromExtension := extension.getSecrets(secretKey, version)
+			endSpan(span, errFromExtension)
+			if !errors.Is(errFromExtension, errExtensionUnavailable) {
+				return result, errFromExtension
+			}
+			logger().Warn("Secrets extension unavailable, falling back to the SDK", "operation", "GetSecrets", "secretId", secretKey)
+		}
 
-	region := "us-east-2"
-	awsSession, _ := session.NewSession(&aws.Config{
-		Region: aws.String(region)},
-	)
+		region := "us-east-2"
+		awsSession, _ := session.NewSession(&aws.Config{
+			Region: aws.String(region)},
+		)
+		traceSession(awsSession)
+		retrySession(awsSession)
+		breakSession(awsSession)
+
+		svc := secretsmanager.New(awsSession)
+
+		return getSecretsFromSvc(aws.BackgroundContext(), svc, secretKey, version)
+	})
+}
 
-	svc := secretsmanager.New(awsSession)
+//getSecretsFromSvc fetches and decodes the secret using the given client
+func getSecretsFromSvc(ctx aws.Context, svc secretsmanageriface.SecretsManagerAPI, secretKey string, version SecretVersion) (map[string]string, error) {
+
+	start := time.Now()
+	opLogger := logger().With("operation", "GetSecretValue", "secretId", secretKey, "versionStage", version.VersionStage, "versionId", version.VersionId)
+
+	result := make(map[string]string)
 
 	input := secretsmanager.GetSecretValueInput{SecretId: &secretKey}
-	output, errFromSvc := svc.GetSecretValue(&input)
+	if version.VersionId != "" {
+		input.VersionId = aws.String(version.VersionId)
+	}
+	if version.VersionStage != "" {
+		input.VersionStage = aws.String(version.VersionStage)
+	}
+	output, errFromSvc := svc.GetSecretValueWithContext(ctx, &input)
+	recordCall("GetSecretValue", "SecretId", secretKey, start, errFromSvc)
 
 	if errFromSvc != nil {
-		fmt.Println(errFromSvc.Error())
+		opLogger.Error("GetSecretValueError", "error", errFromSvc.Error(), "durationMs", sinceMs(start))
 		return nil, errFromSvc
 	}
 	if output.SecretString == nil {
 		errorString := "Unable to find the secrets from the secret manager for the key: " + secretKey
-		fmt.Println(errorString)
+		opLogger.Error("SecretStringNotFound", "durationMs", sinceMs(start))
 		return nil, errors.New(errorString)
 	}
 
 	errFromUnmarshal := json.Unmarshal([]byte(*output.SecretString), &result)
 
 	if errFromUnmarshal != nil {
-		fmt.Println(errFromUnmarshal.Error())
+		opLogger.Error("SecretUnMarshalError", "error", errFromUnmarshal.Error(), "durationMs", sinceMs(start))
 		return nil, errFromUnmarshal
 	}
 
+	opLogger.Debug("Secret Fetched Successfully", "durationMs", sinceMs(start))
 	return result, nil
 }
+
+//GetCurrentAndPreviousSecrets returns the AWSCURRENT and AWSPREVIOUS values of the secret key.
+//previous is nil when the secret has not been rotated yet
+func GetCurrentAndPreviousSecrets(secretKey string) (current, previous map[string]string, err error) {
+
+	current, err = GetSecretsVersion(secretKey, SecretVersion{VersionStage: VersionStageCurrent})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	previous, err = GetSecretsVersion(secretKey, SecretVersion{VersionStage: VersionStagePrevious})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == secretsmanager.ErrCodeResourceNotFoundException {
+			return current, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	return current, previous, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+//GetParameter value from SSM Parameter Store, SecureString values are decrypted.
+//Results are cached when CONFIG_CACHE_TTL is set
+func GetParameter(name string) (string, error) {
+
+	values, err := configCache.getOrFetch("ssm:"+name, func() (map[string]string, error) {
+
+		region := "us-east-2"
+		awsSession, _ := session.NewSession(&aws.Config{
+			Region: aws.String(region)},
+		)
+		traceSession(awsSession)
+		retrySession(awsSession)
+		breakSession(awsSession)
+
+		svc := ssm.New(awsSession)
+
+		value, errFromSvc := getParameterFromSvc(aws.BackgroundContext(), svc, name)
+		if errFromSvc != nil {
+			return nil, errFromSvc
+		}
+		return map[string]string{name: value}, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return values[name], nil
+}
+
+//GetParametersByPath returns every parameter below path, recursively, keyed by its name
+//relative to path. SecureString values are decrypted. Results are cached when CONFIG_CACHE_TTL is set
+func GetParametersByPath(path string) (map[string]string, error) {
+
+	return configCache.getOrFetch("ssm-path:"+path, func() (map[string]string, error) {
+
+		region := "us-east-2"
+		awsSession, _ := session.NewSession(&aws.Config{
+			Region: aws.String(region)},
+		)
+		traceSession(awsSession)
+		retrySession(awsSession)
+		breakSession(awsSession)
+
+		svc := ssm.New(awsSession)
+
+		return getParametersByPathFromSvc(aws.BackgroundContext(), svc, path)
+	})
+}
+
+//getParameterFromSvc fetches a single decrypted parameter using the given client
+func getParameterFromSvc(ctx aws.Context, svc ssmiface.SSMAPI, name string) (string, error) {
+
+	start := time.Now()
+	input := ssm.GetParameterInput{Name: aws.String(name), WithDecryption: aws.Bool(true)}
+	output, errFromSvc := svc.GetParameterWithContext(ctx, &input)
+	recordCall("GetParameter", "Parameter", name, start, errFromSvc)
+	if errFromSvc != nil {
+		logger().Error("GetParameterError", "operation", "GetParameter", "name", name, "error", errFromSvc.Error())
+		return "", errFromSvc
+	}
+	if output.Parameter == nil || output.Parameter.Value == nil {
+		errorString := "Unable to find the parameter from the parameter store for the name: " + name
+		logger().Error("ParameterNotFound", "operation", "GetParameter", "name", name)
+		return "", errors.New(errorString)
+	}
+
+	return *output.Parameter.Value, nil
+}
+
+//getParametersByPathFromSvc pages through every parameter below path using the given client
+func getParametersByPathFromSvc(ctx aws.Context, svc ssmiface.SSMAPI, path string) (map[string]string, error) {
+
+	start := time.Now()
+	result := make(map[string]string)
+	prefix := strings.TrimSuffix(path, "/") + "/"
+
+	input := ssm.GetParametersByPathInput{
+		Path:           aws.String(path),
+		Recursive:      aws.Bool(true),
+		WithDecryption: aws.Bool(true),
+		MaxResults:     aws.Int64(10),
+	}
+	errFromSvc := svc.GetParametersByPathPagesWithContext(ctx, &input, func(page *ssm.GetParametersByPathOutput, lastPage bool) bool {
+		for _, parameter := range page.Parameters {
+			name := strings.TrimPrefix(aws.StringValue(parameter.Name), prefix)
+			result[name] = aws.StringValue(parameter.Value)
+		}
+		return true
+	})
+	recordCall("GetParametersByPath", "Parameter", path, start, errFromSvc)
+	if errFromSvc != nil {
+		logger().Error("GetParametersByPathError", "operation", "GetParametersByPath", "path", path, "error", errFromSvc.Error())
+		return nil, errFromSvc
+	}
+	if len(result) == 0 {
+		errorString := "Unable to find the parameters from the parameter store for the path: " + path
+		logger().Error("ParametersNotFound", "operation", "GetParametersByPath", "path", path)
+		return nil, errors.New(errorString)
+	}
+
+	return result, nil
+}
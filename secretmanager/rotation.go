@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+)
+
+//Rotation steps invoked by Secrets Manager, in order
+const (
+	StepCreateSecret = "createSecret"
+	StepSetSecret    = "setSecret"
+	StepTestSecret   = "testSecret"
+	StepFinishSecret = "finishSecret"
+)
+
+//SecretTypeKey is the key in the secret value naming its credential type
+const SecretTypeKey = "type"
+
+//RotationEvent sent by Secrets Manager to the rotation Lambda
+type RotationEvent struct {
+
+	// ARN or name of the secret being rotated
+	SecretId string `json:"SecretId"`
+
+	// Version ID of the AWSPENDING version for this rotation
+	ClientRequestToken string `json:"ClientRequestToken"`
+
+	// One of createSecret, setSecret, testSecret or finishSecret
+	Step string `json:"Step"`
+}
+
+//CredentialRotator applies a pending secret to the system owning the credential
+type CredentialRotator interface {
+
+	// GenerateSecret builds the pending secret value from the current one
+	GenerateSecret(ctx context.Context, current map[string]string) (map[string]string, error)
+
+	// SetSecret makes the pending credential valid in the downstream system.
+	// It may be retried and must succeed when the credential is already set
+	SetSecret(ctx context.Context, current, pending map[string]string) error
+
+	// TestSecret verifies the pending credential can be used
+	TestSecret(ctx context.Context, pending map[string]string) error
+}
+
+//RotationHandler implements the four step Secrets Manager rotation protocol.
+//Wire it into a Lambda with lambda.Start(handler.Handle)
+type RotationHandler struct {
+
+	// Client used for all Secrets Manager calls, created from the default region when nil
+	Client secretsmanageriface.SecretsManagerAPI
+
+	rotators map[string]CredentialRotator
+}
+
+//RegisterRotator for secrets whose "type" key equals credentialType.
+//An empty credentialType registers the fallback used for untyped secrets
+func (h *RotationHandler) RegisterRotator(credentialType string, rotator CredentialRotator) {
+	if h.rotators == nil {
+		h.rotators = make(map[string]CredentialRotator)
+	}
+	h.rotators[credentialType] = rotator
+}
+
+//Handle a single rotation step
+func (h *RotationHandler) Handle(ctx context.Context, event RotationEvent) error {
+	SetRequestContext(ctx)
+	defer FlushMetrics()
+	defer FlushTraces()
+
+	if h.Client == nil {
+		region := "us-east-2"
+		awsSession, _ := session.NewSession(&aws.Config{
+			Region: aws.String(region)},
+		)
+		traceSession(awsSession)
+		retrySession(awsSession)
+		breakSession(awsSession)
+		h.Client = secretsmanager.New(awsSession)
+	}
+
+	metadata, errDescribe := h.Client.DescribeSecretWithContext(ctx, &secretsmanager.DescribeSecretInput{SecretId: aws.String(event.SecretId)})
+	if errDescribe != nil {
+		errorString := "DescribeSecretError" + "[" + errDescribe.Error() + "]"
+		rotationLogger(event).Error("DescribeSecretError", "error", errDescribe.Error())
+		return errors.New(errorString)
+	}
+	if !aws.BoolValue(metadata.RotationEnabled) {
+		errorString := "RotationNotEnabled" + ": " + event.SecretId
+		rotationLogger(event).Error("RotationNotEnabled")
+		return errors.New(errorString)
+	}
+
+	stages, found := metadata.VersionIdsToStages[event.ClientRequestToken]
+	if !found {
+		errorString := "VersionNotFound" + ": " + event.ClientRequestToken + " for secret " + event.SecretId
+		rotationLogger(event).Error("VersionNotFound")
+		return errors.New(errorString)
+	}
+	if hasStage(stages, VersionStageCurrent) {
+		rotationLogger(event).Info("Version already set as AWSCURRENT")
+		return nil
+	}
+	if !hasStage(stages, VersionStagePending) {
+		errorString := "VersionNotPending" + ": " + event.ClientRequestToken + " for secret " + event.SecretId
+		rotationLogger(event).Error("VersionNotPending")
+		return errors.New(errorString)
+	}
+
+	switch event.Step {
+	case StepCreateSecret:
+		return h.createSecret(ctx, event)
+	case StepSetSecret:
+		return h.setSecret(ctx, event)
+	case StepTestSecret:
+		return h.testSecret(ctx, event)
+	case StepFinishSecret:
+		return h.finishSecret(ctx, event, metadata)
+	}
+
+	errorString := "InvalidRotationStep" + ": " + event.Step
+	rotationLogger(event).Error("InvalidRotationStep")
+	return errors.New(errorString)
+}
+
+//createSecret stores a new AWSPENDING version unless one already exists for the token
+func (h *RotationHandler) createSecret(ctx context.Context, event RotationEvent) error {
+
+	current, errCurrent := getSecretsFromSvc(ctx, h.Client, event.SecretId, SecretVersion{VersionStage: VersionStageCurrent})
+	if errCurrent != nil {
+		return errCurrent
+	}
+
+	_, errPending := getSecretsFromSvc(ctx, h.Client, event.SecretId, SecretVersion{VersionId: event.ClientRequestToken, VersionStage: VersionStagePending})
+	if errPending == nil {
+		rotationLogger(event).Info("Pending secret already created")
+		return nil
+	}
+	if awsErr, ok := errPending.(awserr.Error); !ok || awsErr.Code() != secretsmanager.ErrCodeResourceNotFoundException {
+		return errPending
+	}
+
+	rotator, errRotator := h.rotatorFor(current)
+	if errRotator != nil {
+		return errRotator
+	}
+
+	pending, errGenerate := rotator.GenerateSecret(ctx, current)
+	if errGenerate != nil {
+		errorString := "GenerateSecretError" + "[" + errGenerate.Error() + "]"
+		rotationLogger(event).Error("GenerateSecretError", "error", errGenerate.Error())
+		return errors.New(errorString)
+	}
+	if _, ok := pending[SecretTypeKey]; !ok && current[SecretTypeKey] != "" {
+		pending[SecretTypeKey] = current[SecretTypeKey]
+	}
+
+	secretString, errMarshal := json.Marshal(pending)
+	if errMarshal != nil {
+		errorString := "Marshal Secret Error" + "[" + errMarshal.Error() + "]"
+		rotationLogger(event).Error("Marshal Secret Error", "error", errMarshal.Error())
+		return errors.New(errorString)
+	}
+
+	_, errPut := h.Client.PutSecretValueWithContext(ctx, &secretsmanager.PutSecretValueInput{
+		SecretId:           aws.String(event.SecretId),
+		ClientRequestToken: aws.String(event.ClientRequestToken),
+		SecretString:       aws.String(string(secretString)),
+		VersionStages:      []*string{aws.String(VersionStagePending)},
+	})
+	if errPut != nil {
+		errorString := "PutSecretValueError" + "[" + errPut.Error() + "]"
+		rotationLogger(event).Error("PutSecretValueError", "error", errPut.Error())
+		return errors.New(errorString)
+	}
+
+	rotationLogger(event).Info("Pending secret Created Successfully")
+	return nil
+}
+
+//setSecret applies the pending credential downstream
+func (h *RotationHandler) setSecret(ctx context.Context, event RotationEvent) error {
+
+	current, errCurrent := getSecretsFromSvc(ctx, h.Client, event.SecretId, SecretVersion{VersionStage: VersionStageCurrent})
+	if errCurrent != nil {
+		return errCurrent
+	}
+
+	pending, errPending := getSecretsFromSvc(ctx, h.Client, event.SecretId, SecretVersion{VersionId: event.ClientRequestToken, VersionStage: VersionStagePending})
+	if errPending != nil {
+		return errPending
+	}
+
+	rotator, errRotator := h.rotatorFor(pending)
+	if errRotator != nil {
+		return errRotator
+	}
+
+	if errSet := rotator.SetSecret(ctx, current, pending); errSet != nil {
+		errorString := "SetSecretError" + "[" + errSet.Error() + "]"
+		rotationLogger(event).Error("SetSecretError", "error", errSet.Error())
+		return errors.New(errorString)
+	}
+
+	rotationLogger(event).Info("Pending secret Set Successfully")
+	return nil
+}
+
+//testSecret verifies the pending credential
+func (h *RotationHandler) testSecret(ctx context.Context, event RotationEvent) error {
+
+	pending, errPending := getSecretsFromSvc(ctx, h.Client, event.SecretId, SecretVersion{VersionId: event.ClientRequestToken, VersionStage: VersionStagePending})
+	if errPending != nil {
+		return errPending
+	}
+
+	rotator, errRotator := h.rotatorFor(pending)
+	if errRotator != nil {
+		return errRotator
+	}
+
+	if errTest := rotator.TestSecret(ctx, pending); errTest != nil {
+		errorString := "TestSecretError" + "[" + errTest.Error() + "]"
+		rotationLogger(event).Error("TestSecretError", "error", errTest.Error())
+		return errors.New(errorString)
+	}
+
+	rotationLogger(event).Info("Pending secret Tested Successfully")
+	return nil
+}
+
+//finishSecret moves AWSCURRENT to the pending version, which marks the old one AWSPREVIOUS
+func (h *RotationHandler) finishSecret(ctx context.Context, event RotationEvent, metadata *secretsmanager.DescribeSecretOutput) error {
+
+	currentVersion := ""
+	for versionID, stages := range metadata.VersionIdsToStages {
+		if hasStage(stages, VersionStageCurrent) {
+			currentVersion = versionID
+			break
+		}
+	}
+	if currentVersion == event.ClientRequestToken {
+		return nil
+	}
+
+	input := &secretsmanager.UpdateSecretVersionStageInput{
+		SecretId:        aws.String(event.SecretId),
+		VersionStage:    aws.String(VersionStageCurrent),
+		MoveToVersionId: aws.String(event.ClientRequestToken),
+	}
+	if currentVersion != "" {
+		input.RemoveFromVersionId = aws.String(currentVersion)
+	}
+
+	_, errUpdate := h.Client.UpdateSecretVersionStageWithContext(ctx, input)
+	if errUpdate != nil {
+		errorString := "UpdateSecretVersionStageError" + "[" + errUpdate.Error() + "]"
+		rotationLogger(event).Error("UpdateSecretVersionStageError", "error", errUpdate.Error())
+		return errors.New(errorString)
+	}
+
+	configCache.invalidate()
+
+	rotationLogger(event).Info("Version marked as AWSCURRENT")
+	return nil
+}
+
+//rotatorFor the credential type recorded in the secret
+func (h *RotationHandler) rotatorFor(secret map[string]string) (CredentialRotator, error) {
+	if rotator, ok := h.rotators[secret[SecretTypeKey]]; ok {
+		return rotator, nil
+	}
+	if rotator, ok := h.rotators[""]; ok {
+		return rotator, nil
+	}
+	errorString := "NoRotatorRegistered" + ": " + secret[SecretTypeKey]
+	logger().Error("NoRotatorRegistered", "operation", "RotateSecret", "credentialType", secret[SecretTypeKey])
+	return nil, errors.New(errorString)
+}
+
+//rotationLogger tags entries with the secret, step and version being rotated
+func rotationLogger(event RotationEvent) *slog.Logger {
+	return logger().With("operation", "RotateSecret", "secretId", event.SecretId, "step", event.Step, "versionId", event.ClientRequestToken)
+}
+
+func hasStage(stages []*string, stage string) bool {
+	for _, s := range stages {
+		if aws.StringValue(s) == stage {
+			return true
+		}
+	}
+	return false
+}
+
+//GeneratePassword of the given length using Secrets Manager, for use in GenerateSecret
+func GeneratePassword(ctx context.Context, svc secretsmanageriface.SecretsManagerAPI, length int64) (string, error) {
+	output, errGenerate := svc.GetRandomPasswordWithContext(ctx, &secretsmanager.GetRandomPasswordInput{
+		PasswordLength:          aws.Int64(length),
+		ExcludeCharacters:       aws.String("/@\"'\\"),
+		RequireEachIncludedType: aws.Bool(true),
+	})
+	if errGenerate != nil {
+		errorString := "GetRandomPasswordError" + "[" + errGenerate.Error() + "]"
+		logger().Error("GetRandomPasswordError", "operation", "GeneratePassword", "error", errGenerate.Error())
+		return "", errors.New(errorString)
+	}
+	return aws.StringValue(output.RandomPassword), nil
+}
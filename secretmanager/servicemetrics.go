@@ -0,0 +1,23 @@
+package main
+
+import "time"
+
+//recordCall emits the latency of a call for the secret or parameter named by the dimension,
+//and its error type and throttling on failure
+func recordCall(operation, dimension, resource string, start time.Time, err error) {
+	dimensions := func() map[string]string {
+		return map[string]string{"Operation": operation, dimension: resource}
+	}
+
+	putMetric("Latency", float64(sinceMs(start)), UnitMilliseconds, dimensions())
+	if err == nil {
+		return
+	}
+
+	errorDimensions := dimensions()
+	errorDimensions["ErrorType"] = errorType(err)
+	putMetric("Errors", 1, UnitCount, errorDimensions)
+	if isThrottle(err) {
+		putMetric("Throttles", 1, UnitCount, dimensions())
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"reflect"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+//paramAttributes of the secret or parameters a request is made for
+func paramAttributes(params reflect.Value) []attribute.KeyValue {
+
+	var attributes []attribute.KeyValue
+	if secretID := stringParam(params, "SecretId"); secretID != "" {
+		attributes = append(attributes, attribute.String("aws.secretsmanager.secret_id", secretID))
+	}
+	if name := stringParam(params, "Name"); name != "" {
+		attributes = append(attributes, attribute.String("aws.ssm.parameter_name", name))
+	}
+	if path := stringParam(params, "Path"); path != "" {
+		attributes = append(attributes, attribute.String("aws.ssm.parameter_path", path))
+	}
+	return attributes
+}
@@ -0,0 +1,25 @@
+package main
+
+//ConfigSource resolves a named group of config values, so callers can switch
+//between Secrets Manager and SSM Parameter Store
+type ConfigSource interface {
+
+	// GetValues of the secret or parameter path identified by name
+	GetValues(name string) (map[string]string, error)
+}
+
+//SecretsManagerSource reads the JSON key/value pairs of a secret through GetSecrets
+type SecretsManagerSource struct{}
+
+//GetValues of the secret
+func (SecretsManagerSource) GetValues(name string) (map[string]string, error) {
+	return GetSecrets(name)
+}
+
+//ParameterStoreSource reads every parameter below a path through GetParametersByPath
+type ParameterStoreSource struct{}
+
+//GetValues below the parameter path, keyed by the name relative to the path
+func (ParameterStoreSource) GetValues(name string) (map[string]string, error) {
+	return GetParametersByPath(name)
+}
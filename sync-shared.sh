@@ -0,0 +1,46 @@
+#!/bin/sh
+# sync-shared.sh copies the AWS client helpers shared by the Lambda programs
+# from dynamodb into s3 and secretmanager.
+#
+# Each directory is a standalone "package main" without a module path, so the
+# helpers cannot live in an importable internal package. The dynamodb files are
+# the only source: edit them, then run this script (or "go generate" in
+# dynamodb). Service specific metrics and span attributes stay in each
+# program's servicemetrics.go and servicetracing.go.
+#
+# Usage: sync-shared.sh [-check]
+#   -check  fail, without writing, when a copy differs from its source
+
+set -e
+
+cd "$(dirname "$0")"
+
+source_dir=dynamodb
+targets="s3 secretmanager"
+files="retry.go breaker.go logger.go metrics.go tracing.go"
+
+check=false
+if [ "$1" = "-check" ]; then
+	check=true
+fi
+
+generated() {
+	echo "// Code generated by sync-shared.sh from $source_dir/$1. DO NOT EDIT."
+	echo
+	awk '/^\/\/go:generate /{skip=1; next} skip && $0 == ""{skip=0; next} {skip=0; print}' "$source_dir/$1"
+}
+
+status=0
+for target in $targets; do
+	for file in $files; do
+		if $check; then
+			if ! generated "$file" | cmp -s - "$target/$file"; then
+				echo "$target/$file is out of date, run sync-shared.sh" >&2
+				status=1
+			fi
+		else
+			generated "$file" >"$target/$file"
+		fi
+	done
+done
+exit $status